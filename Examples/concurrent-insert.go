@@ -0,0 +1,75 @@
+package main
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"dbx/database"
+)
+
+// 很多個 goroutine 同時對同一個 sqlite 檔案 Insert, 檢查每筆資料都拿到不同的 ObjId,
+// 屬性也沒有混在一起，用法:
+//   cp Examples/concurrent-insert.go main.go && go build && ./dbx /tmp/concurrent.sqlite3
+
+const (
+	workers = 32
+	perWorker = 50
+)
+
+func main() {
+	dbPath := "db.sqlite3"
+	if len(os.Args) > 1 {
+		dbPath = os.Args[1]
+	}
+	db, err := database.Connect(dbPath)
+	if err != nil {
+		fmt.Printf("Connect to %s: %s\n", dbPath, err.Error())
+		return
+	}
+	tb := "demo"
+	if err := db.CreateTb(tb, true); err != nil {
+		fmt.Printf("Create Table %s: %s\n", tb, err.Error())
+		return
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				item := map[string]interface{}{"Worker": w, "Seq": i}
+				if _, err := db.MapInsert(tb, item); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		fmt.Printf("MapInsert: %s\n", err.Error())
+		return
+	}
+
+	items, err := db.FindAll(tb)
+	if err != nil {
+		fmt.Printf("FindAll: %s\n", err.Error())
+		return
+	}
+	ids := map[int]bool{}
+	for _, item := range items {
+		if len(item) != 4 { // Id, Worker, Seq, Version
+			fmt.Printf("FAIL: attributes merged: %v\n", item)
+			return
+		}
+		ids[item["Id"].(int)] = true
+	}
+	if len(items) != workers*perWorker || len(ids) != len(items) {
+		fmt.Printf("FAIL: %d objects, %d distinct ObjId, want %d\n", len(items), len(ids), workers*perWorker)
+		return
+	}
+	fmt.Printf("OK: %d objects with distinct ObjId\n", len(items))
+}
@@ -0,0 +1,210 @@
+package database
+
+// 對整個表格所有物件的某個屬性做修改，主要給 dbx/migrate 的 migration 使用:
+//   n, err := db.RenameAttr("member", "Nick", "Name")    // 改名，已經有 Name 的物件會讓整個操作失敗
+//   n, err := db.RetypeAttr("member", "Age", "int")      // 依新的 Typ 重新編碼 Val, 例如 "30"(string) 變成 30(int)
+//   n, err := db.DefaultAttr("member", "Level", 1)       // 沒有 Level 的物件補上 1
+//   n, err := db.DropAttr("member", "Tmp")               // 所有物件刪除 Tmp
+// n 是受影響的物件數，RenameAttr()/RetypeAttr() 在一個交易內完成，失敗時不會改到一半
+// 受影響的物件跟 Update 一樣 Version 加 1; Version 由 database 維護，只能用 DropAttr() 刪掉(不再加 1)
+
+import (
+	"context"
+	dbsql "database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// RenameAttr 把屬性 from 改名為 to
+func (db *Db) RenameAttr(tb, from, to string) (int, error) {
+	return db.RenameAttrCtx(context.Background(), tb, from, to)
+}
+
+func (db *Db) RenameAttrCtx(ctx context.Context, tb, from, to string) (int, error) {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return 0, err
+	}
+	if from == "Id" || to == "Id" {
+		return 0, fmt.Errorf("RenameAttr(%s): Id is not an attribute", tb)
+	}
+	if from == VersionAttr || to == VersionAttr {
+		return 0, fmt.Errorf("RenameAttr(%s): %s is maintained by database", tb, VersionAttr)
+	}
+	n := 0
+	err = db.atomic(ctx, func(db *Db) error {
+		conflict := 0
+		sql := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE Attr=? AND ObjId IN (SELECT ObjId FROM %s WHERE Attr=?);", name, name)
+		if err := db.x().QueryRowxContext(ctx, db.rebind(sql), from, to).Scan(&conflict); err != nil {
+			return queryError(name, sql, err)
+		}
+		if conflict > 0 {
+			return fmt.Errorf("RenameAttr(%s): %d objects already have attribute %q", tb, conflict, to)
+		}
+		if err := db.bumpVersionsWhere(ctx, name, "Attr=?", []interface{}{from}); err != nil {
+			return err
+		}
+		return db.trackedAs(ctx, name, EventUpdate, "Attr IN (?,?)", []interface{}{from, to}, func(db *Db) error {
+			sql := fmt.Sprintf("UPDATE %s SET Attr=? WHERE Attr=?;", name)
+			res, err := db.x().ExecContext(ctx, db.rebind(sql), to, from)
+			if err != nil {
+				return queryError(name, sql, err)
+			}
+			n = affected(res)
+			return nil
+		})
+	})
+	return n, err
+}
+
+// RetypeAttr 把屬性 attr 的值轉成 typ 後重新編碼, 數字之間要能無損轉換，字串則依 typ 解析，
+// 任何一個物件轉換失敗就全部不改, nil 保持不變
+func (db *Db) RetypeAttr(tb, attr, typ string) (int, error) {
+	return db.RetypeAttrCtx(context.Background(), tb, attr, typ)
+}
+
+func (db *Db) RetypeAttrCtx(ctx context.Context, tb, attr, typ string) (int, error) {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return 0, err
+	}
+	if typ != "json" && lookupName(typ) == nil {
+		return 0, fmt.Errorf("RetypeAttr(%s): unknown Typ %q", tb, typ)
+	}
+	if attr == VersionAttr {
+		return 0, fmt.Errorf("RetypeAttr(%s): %s is maintained by database", tb, VersionAttr)
+	}
+	n := 0
+	err = db.trackedAs(ctx, name, EventUpdate, "Attr=?", []interface{}{attr}, func(db *Db) error {
+		return db.atomic(ctx, func(db *Db) error {
+			rows := []Table{}
+			sql := fmt.Sprintf("SELECT Id,ObjId,Attr,Val,Typ FROM %s WHERE Attr=? AND Typ<>? AND Typ<>'nil';", name)
+			if err := sqlx.SelectContext(ctx, db.x(), &rows, db.rebind(sql), attr, typ); err != nil {
+				return queryError(name, sql, err)
+			}
+			sql = fmt.Sprintf("UPDATE %s SET Val=?, Typ=? WHERE Id=?;", name)
+			ids := make([]int, 0, len(rows))
+			for _, r := range rows {
+				val, err := retypeVal(r, typ)
+				if err != nil {
+					return fmt.Errorf("RetypeAttr(%s): ObjId %d: %s", tb, r.ObjId, err.Error())
+				}
+				if _, err := db.x().ExecContext(ctx, db.rebind(sql), val, typ, r.Id); err != nil {
+					return queryError(name, sql, err)
+				}
+				ids = append(ids, r.ObjId)
+			}
+			n = len(rows)
+			return db.bumpVersions(ctx, name, ids)
+		})
+	})
+	return n, err
+}
+
+// retypeVal 傳回 r 轉成 typ 之後的 Val
+func retypeVal(r Table, typ string) (string, error) {
+	if val, err := convertVal(r, typ); err == nil { // 數字之間
+		return val, nil
+	}
+	switch {
+	case typ == "string":
+		return r.Val, nil // 保持原本的字串形式，例如時間是 RFC3339
+	case typ == "json":
+		if r.Typ == "string" {
+			if _, err := decodeJSON(r.Val); err != nil {
+				return "", err
+			}
+			return r.Val, nil
+		}
+		b, err := json.Marshal(decodeAttr(r.Typ, r.Val))
+		return string(b), err
+	case r.Typ == "string":
+		v, err := lookupName(typ).dec(r.Val)
+		if err != nil {
+			return "", err
+		}
+		return lookupName(typ).enc(reflect.ValueOf(v))
+	}
+	return "", fmt.Errorf("cannot convert %s %s to %s", r.Typ, r.Val, typ)
+}
+
+// DefaultAttr 沒有屬性 attr 的物件補上 v, 已經有的(包括 nil) 不變
+func (db *Db) DefaultAttr(tb, attr string, v interface{}) (int, error) {
+	return db.DefaultAttrCtx(context.Background(), tb, attr, v)
+}
+
+func (db *Db) DefaultAttrCtx(ctx context.Context, tb, attr string, v interface{}) (int, error) {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return 0, err
+	}
+	if attr == "Id" {
+		return 0, fmt.Errorf("DefaultAttr(%s): Id is not an attribute", tb)
+	}
+	if attr == VersionAttr {
+		return 0, fmt.Errorf("DefaultAttr(%s): %s is maintained by database", tb, VersionAttr)
+	}
+	val, typ, err := encodeAttr(v)
+	if err != nil {
+		return 0, fmt.Errorf("DefaultAttr(%s): %s", tb, err.Error())
+	}
+	missing := fmt.Sprintf("ObjId NOT IN (SELECT ObjId FROM %s WHERE Attr=?)", name)
+	sql := fmt.Sprintf("INSERT INTO %s (ObjId,Attr,Val,Typ) SELECT DISTINCT ObjId, ?, ?, ? FROM %s WHERE %s;", name, name, missing)
+	n := 0
+	err = db.atomic(ctx, func(db *Db) error {
+		if err := db.bumpVersionsWhere(ctx, name, missing, []interface{}{attr}); err != nil {
+			return err
+		}
+		return db.trackedAs(ctx, name, EventUpdate, "Attr=?", []interface{}{attr}, func(db *Db) error {
+			res, err := db.x().ExecContext(ctx, db.rebind(sql), attr, val, typ, attr)
+			if err != nil {
+				return queryError(name, sql, err)
+			}
+			n = affected(res)
+			return nil
+		})
+	})
+	return n, err
+}
+
+// DropAttr 所有物件刪除屬性 attr, 只有這個屬性的物件也就不存在了
+func (db *Db) DropAttr(tb, attr string) (int, error) {
+	return db.DropAttrCtx(context.Background(), tb, attr)
+}
+
+func (db *Db) DropAttrCtx(ctx context.Context, tb, attr string) (int, error) {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	err = db.atomic(ctx, func(db *Db) error {
+		if attr != VersionAttr {
+			if err := db.bumpVersionsWhere(ctx, name, "Attr=?", []interface{}{attr}); err != nil {
+				return err
+			}
+		}
+		return db.trackedAs(ctx, name, EventUpdate, "Attr=?", []interface{}{attr}, func(db *Db) error {
+			sql := fmt.Sprintf("DELETE FROM %s WHERE Attr=?;", name)
+			res, err := db.x().ExecContext(ctx, db.rebind(sql), attr)
+			if err != nil {
+				return queryError(name, sql, err)
+			}
+			n = affected(res)
+			return nil
+		})
+	})
+	return n, err
+}
+
+// affected 傳回受影響的筆數，driver 不支援時為 0
+func affected(res dbsql.Result) int {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0
+	}
+	return int(n)
+}
@@ -0,0 +1,358 @@
+package database
+
+// 寫入時 Val 一律存成字串，Typ 記錄原本的型態，這邊負責兩者之間的轉換
+// 每一種 Typ 都對應一組 codec (encode/decode), 內建的有:
+//   bool, string, int, int8 ~ int64, uint, uint8 ~ uint64, uintptr, float32, float64,
+//   complex64, complex128, []byte, time.Time, time.Duration, Time(dbx/time.Time), nil
+// 巢狀的值(struct, slice, map) 以 JSON 存放，Typ 記為 "json", 讀出時還原成 []interface{} 與 map[string]interface{}
+// 指標會先取值再編碼，nil 指標存成 Typ "nil"
+// 自訂型態用 RegisterType() 註冊，沒註冊的自訂型態會依 Kind 當成對應的內建型態，例如 type Status int 存成 "int"
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	t "dbx/time"
+)
+
+type codec struct {
+	name string
+	typ  reflect.Type
+	enc  func(v reflect.Value) (string, error)
+	dec  func(s string) (interface{}, error)
+}
+
+var (
+	codecMu     sync.RWMutex
+	codecByType = map[reflect.Type]*codec{}
+	codecByName = map[string]*codec{}
+)
+
+var (
+	errorType  = reflect.TypeOf((*error)(nil)).Elem()
+	stringType = reflect.TypeOf("")
+)
+
+// RegisterType 註冊自訂型態, name 會存到 Typ 欄位,
+// encode 必須是 func(T) (string, error), decode 必須是 func(string) (T, error), 例如:
+//   database.RegisterType("Money",
+//       func(m Money) (string, error) { return m.String(), nil },
+//       func(s string) (Money, error) { return ParseMoney(s) })
+// 同一個 name 或型態重複註冊時，後註冊的會蓋掉先前的，包括內建的型態
+func RegisterType(name string, encode, decode interface{}) error {
+	if name == "" || name == "json" || name == "nil" {
+		return fmt.Errorf("RegisterType: invalid name %q", name)
+	}
+	ev, dv := reflect.ValueOf(encode), reflect.ValueOf(decode)
+	if ev.Kind() != reflect.Func || dv.Kind() != reflect.Func {
+		return fmt.Errorf("RegisterType(%s): encode and decode must be functions", name)
+	}
+	et, dt := ev.Type(), dv.Type()
+	if et.NumIn() != 1 || et.NumOut() != 2 || et.Out(0) != stringType || et.Out(1) != errorType {
+		return fmt.Errorf("RegisterType(%s): encode must be func(T) (string, error), got %s", name, et)
+	}
+	typ := et.In(0)
+	if dt.NumIn() != 1 || dt.In(0) != stringType || dt.NumOut() != 2 || dt.Out(0) != typ || dt.Out(1) != errorType {
+		return fmt.Errorf("RegisterType(%s): decode must be func(string) (%s, error), got %s", name, typ, dt)
+	}
+	register(&codec{
+		name: name,
+		typ:  typ,
+		enc: func(v reflect.Value) (string, error) {
+			out := ev.Call([]reflect.Value{v})
+			if err, _ := out[1].Interface().(error); err != nil {
+				return "", err
+			}
+			return out[0].String(), nil
+		},
+		dec: func(s string) (interface{}, error) {
+			out := dv.Call([]reflect.Value{reflect.ValueOf(s)})
+			if err, _ := out[1].Interface().(error); err != nil {
+				return nil, err
+			}
+			return out[0].Interface(), nil
+		},
+	})
+	return nil
+}
+
+func register(c *codec) {
+	codecMu.Lock()
+	defer codecMu.Unlock()
+	if old, ok := codecByName[c.name]; ok && codecByType[old.typ] == old {
+		delete(codecByType, old.typ)
+	}
+	codecByName[c.name] = c
+	codecByType[c.typ] = c
+}
+
+func lookupType(typ reflect.Type) *codec {
+	codecMu.RLock()
+	defer codecMu.RUnlock()
+	return codecByType[typ]
+}
+
+func lookupName(name string) *codec {
+	codecMu.RLock()
+	defer codecMu.RUnlock()
+	return codecByName[name]
+}
+
+// encodeAttr 傳回 v 要存入的 Val 與 Typ
+func encodeAttr(v interface{}) (string, string, error) {
+	if n, ok := v.(json.Number); ok { // json 的數字, 整數存成 int64, 其餘存成 float64
+		if i, err := n.Int64(); err == nil {
+			v = i
+		} else if f, err := n.Float64(); err == nil {
+			v = f
+		}
+	}
+	rv := reflect.ValueOf(v)
+	for rv.IsValid() {
+		if c := lookupType(rv.Type()); c != nil {
+			val, err := c.enc(rv)
+			return val, c.name, err
+		}
+		if rv.Kind() != reflect.Ptr && rv.Kind() != reflect.Interface {
+			break
+		}
+		if rv.IsNil() {
+			return "", "nil", nil
+		}
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		return "", "nil", nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 { // 自訂的 []byte
+			return encodeKind("[]byte", rv)
+		}
+		fallthrough
+	case reflect.Struct, reflect.Array, reflect.Map:
+		b, err := json.Marshal(rv.Interface())
+		if err != nil {
+			return "", "", err
+		}
+		return string(b), "json", nil
+	}
+	return encodeKind(rv.Kind().String(), rv)
+}
+
+// encodeKind 沒註冊的自訂型態，轉成同 Kind 的內建型態再編碼
+func encodeKind(name string, rv reflect.Value) (string, string, error) {
+	c := lookupName(name)
+	if c == nil || !rv.Type().ConvertibleTo(c.typ) {
+		return "", "", fmt.Errorf("unsupported type %s", rv.Type())
+	}
+	val, err := c.enc(rv.Convert(c.typ))
+	return val, c.name, err
+}
+
+// typName 傳回型態為 typ 的值存入時的 Typ, 規則同 encodeAttr(), interface 則傳回 ""
+func typName(typ reflect.Type) string {
+	for {
+		if c := lookupType(typ); c != nil {
+			return c.name
+		}
+		if typ.Kind() != reflect.Ptr {
+			break
+		}
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Interface:
+		return ""
+	case reflect.Slice:
+		if typ.Elem().Kind() == reflect.Uint8 {
+			return "[]byte"
+		}
+		return "json"
+	case reflect.Struct, reflect.Array, reflect.Map:
+		return "json"
+	}
+	return typ.Kind().String()
+}
+
+// encodeVal 只要 Val, 給 filter 比對用
+func encodeVal(v interface{}) string {
+	val, _, err := encodeAttr(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return val
+}
+
+// decodeAttr 依 Typ 還原 Val, 不認得的 Typ 或格式錯誤時傳回原本的字串
+func decodeAttr(typ, val string) interface{} {
+	switch typ {
+	case "nil":
+		return nil
+	case "json":
+		if v, err := decodeJSON(val); err == nil {
+			return v
+		}
+		return val
+	}
+	if c := lookupName(typ); c != nil {
+		if v, err := c.dec(val); err == nil {
+			return v
+		}
+	}
+	return val
+}
+
+// decodeJSON 還原以 JSON 存放的值，數字是整數時還原成 int, 否則為 float64
+func decodeJSON(s string) (interface{}, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewBufferString(s))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return jsonNumber(v), nil
+}
+
+func jsonNumber(v interface{}) interface{} {
+	switch tv := v.(type) {
+	case json.Number:
+		if i, err := tv.Int64(); err == nil && int64(int(i)) == i {
+			return int(i)
+		}
+		f, _ := tv.Float64()
+		return f
+	case []interface{}:
+		for i := range tv {
+			tv[i] = jsonNumber(tv[i])
+		}
+	case map[string]interface{}:
+		for k := range tv {
+			tv[k] = jsonNumber(tv[k])
+		}
+	}
+	return v
+}
+
+// parseTime 先試 RFC3339Nano, 再試舊版以 %v 存入的格式
+func parseTime(v string) (time.Time, error) {
+	if tt, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return tt, nil
+	}
+	return time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", v)
+}
+
+// 時間一律轉成 UTC 並存成 RFC3339Nano, 這樣才不會遺失時區與小數秒
+func formatTime(tt time.Time) string {
+	return tt.UTC().Format(time.RFC3339Nano)
+}
+
+func init() {
+	ints := []interface{}{int(0), int8(0), int16(0), int32(0), int64(0)}
+	for _, z := range ints {
+		typ := reflect.TypeOf(z)
+		bits := typ.Bits()
+		register(&codec{
+			name: typ.String(),
+			typ:  typ,
+			enc: func(v reflect.Value) (string, error) {
+				return strconv.FormatInt(v.Int(), 10), nil
+			},
+			dec: func(s string) (interface{}, error) {
+				i, err := strconv.ParseInt(s, 10, bits)
+				if err != nil {
+					return nil, err
+				}
+				return reflect.ValueOf(i).Convert(typ).Interface(), nil
+			},
+		})
+	}
+
+	uints := []interface{}{uint(0), uint8(0), uint16(0), uint32(0), uint64(0), uintptr(0)}
+	for _, z := range uints {
+		typ := reflect.TypeOf(z)
+		bits := typ.Bits()
+		register(&codec{
+			name: typ.String(),
+			typ:  typ,
+			enc: func(v reflect.Value) (string, error) {
+				return strconv.FormatUint(v.Uint(), 10), nil
+			},
+			dec: func(s string) (interface{}, error) {
+				u, err := strconv.ParseUint(s, 10, bits)
+				if err != nil {
+					return nil, err
+				}
+				return reflect.ValueOf(u).Convert(typ).Interface(), nil
+			},
+		})
+	}
+
+	floats := []interface{}{float32(0), float64(0)}
+	for _, z := range floats {
+		typ := reflect.TypeOf(z)
+		bits := typ.Bits()
+		register(&codec{
+			name: typ.String(),
+			typ:  typ,
+			enc: func(v reflect.Value) (string, error) {
+				return strconv.FormatFloat(v.Float(), 'g', -1, bits), nil
+			},
+			dec: func(s string) (interface{}, error) {
+				f, err := strconv.ParseFloat(s, bits)
+				if err != nil {
+					return nil, err
+				}
+				return reflect.ValueOf(f).Convert(typ).Interface(), nil
+			},
+		})
+	}
+
+	complexes := []interface{}{complex64(0), complex128(0)}
+	for _, z := range complexes {
+		typ := reflect.TypeOf(z)
+		register(&codec{
+			name: typ.String(),
+			typ:  typ,
+			enc: func(v reflect.Value) (string, error) {
+				return fmt.Sprint(v.Interface()), nil
+			},
+			dec: func(s string) (interface{}, error) {
+				p := reflect.New(typ)
+				if _, err := fmt.Sscan(s, p.Interface()); err != nil {
+					return nil, err
+				}
+				return p.Elem().Interface(), nil
+			},
+		})
+	}
+
+	RegisterType("bool",
+		func(b bool) (string, error) { return strconv.FormatBool(b), nil },
+		strconv.ParseBool)
+	RegisterType("string",
+		func(s string) (string, error) { return s, nil },
+		func(s string) (string, error) { return s, nil })
+	RegisterType("[]byte",
+		func(b []byte) (string, error) { return base64.StdEncoding.EncodeToString(b), nil },
+		base64.StdEncoding.DecodeString)
+	RegisterType("time.Time",
+		func(tt time.Time) (string, error) { return formatTime(tt), nil },
+		parseTime)
+	RegisterType("time.Duration",
+		func(d time.Duration) (string, error) { return d.String(), nil },
+		time.ParseDuration)
+	RegisterType("Time",
+		func(tt t.Time) (string, error) { return formatTime(time.Time(tt)), nil },
+		func(s string) (t.Time, error) {
+			tt, err := parseTime(s)
+			return t.Time(tt), err
+		})
+}
@@ -8,21 +8,38 @@ package database
 //   1. 最基本的是將兩個表格的資料關聯起來，這種用法跟 JOIN 相似但有區別，不多說
 //   2. 這邊因為是直式表格設計，用來過濾特定欄位範例，請見 GetsByFilter()
 // 參考: [SQL 子查詢](https://www.1keydata.com/tw/sql/sql-subquery.html)
+//
+// 每個會存取資料庫的函式都有一個 XxxCtx(ctx, ...) 的版本，可以取消或設定期限，
+// 例如 GetCtx(), InsertCtx(), 原本的函式就是用 context.Background() 呼叫 XxxCtx()
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
 	_ "github.com/mattn/go-sqlite3"
 	"strings"
-    "strconv"
-    "time"
-
-    t "dbx/time"
+	"time"
 )
 
 // 採用 struct 的方式，可以在 Db struct 放入更多屬性
 type Db struct {
 	Db *sqlx.DB
+	Logger Logger	// Get 系列出錯時的記錄，nil 則印到 stdout
+
+	dialect Dialect	// 見 Dialect()
+	// schemas/history/softDel/subs 只記在這個 Db 裡，不會存進資料庫，程式啟動時要再設定一次，也不會收到其他程式的變動
+	// Tx 內的 Db 是複製的，所以用指標讓 Db 與它的 Tx 共用同一份
+	schemas *schemas	// 見 SetSchema()
+	history *tableSet	// 見 EnableHistory()
+	softDel *tableSet	// 見 EnableSoftDelete()
+	withDeleted bool	// 見 IncludeDeleted()
+	subs *subscribers	// 見 Subscribe()
+	events *eventBuf	// 交易內還沒送出的事件
+	histAt *time.Time	// 交易內記錄 history 的時間，見 trackedAs()
+	tx    *sqlx.Tx	// 不是 nil 表示在交易內，見 Tx()
+	depth int		// savepoint 的層數
 }
 
 // 所有資料表都使用制式表格, 為一種直式表格，
@@ -35,44 +52,125 @@ type Table struct {
 	Typ		string	`db:"Typ"`
 }
 
-// Connect 連接到 MariaDB, 需要
-// (u)sername, (p)assword, ip, port(=3306), (d)atabase
+// Connect 依照 path 的格式連接到 sqlite3, MySQL/MariaDB 或 PostgreSQL, 格式請見 ParseDSN()
+// 一般的檔案路徑就是 sqlite3
 func Connect(path string) (db *Db, err error) {
-	db = &Db{}
-	db.Db, err = sqlx.Connect("sqlite3", path)
-	return db, err
+	dialect, dsn := ParseDSN(path)
+	db = &Db{dialect: dialect, schemas: &schemas{m: map[Ident]*Schema{}}, history: newTableSet(), softDel: newTableSet(), subs: newSubscribers()}
+	db.Db, err = sqlx.Connect(dialect.Name(), dsn)
+	if err != nil {
+		return db, err
+	}
+	if dialect.Name() == "postgres" { // 欄位名稱傳回來都是小寫
+		db.Db.Mapper = reflectx.NewMapperTagFunc("db", strings.ToLower, strings.ToLower)
+	}
+	return db, db.createSeq(context.Background())
 }
 
 func (db *Db) String() string {
-	return "sqlite3"
+	return db.Dialect().Name()
+}
+
+// Dialect 傳回目前使用的 Dialect, 自己建立的 Db{Db: ...} 則依照 driver 名稱判斷
+func (db *Db) Dialect() Dialect {
+	if db.dialect != nil {
+		return db.dialect
+	}
+	if d, err := DialectOf(db.Db.DriverName()); err == nil {
+		return d
+	}
+	return sqliteDialect{}
 }
 
 // dropFirst = true 時會先 drop table, 失敗則停止，
 //             false 則會嚐試 create table, 已存在仍返回成功
 func (db *Db) CreateTb(tb string, dropFirst bool) (err error) {
+	return db.CreateTbCtx(context.Background(), tb, dropFirst)
+}
+
+func (db *Db) CreateTbCtx(ctx context.Context, tb string, dropFirst bool) (err error) {
+	if _, err = ParseIdent(tb); err != nil {
+		return err
+	}
 	if dropFirst {
-		var dropSql = fmt.Sprintf("DROP TABLE IF EXISTS %s;", tb)
-		_, err = db.Db.Exec(dropSql)
-		if err != nil {
-			return fmt.Errorf("%s\n\t%s", err.Error(), dropSql)
+		if err = db.DropTbCtx(ctx, tb); err != nil {
+			return err
 		}
 	}
 
-	var schema = fmt.Sprintf("CREATE TABLE %s ( Id INTEGER PRIMARY KEY AUTOINCREMENT, ObjId INTEGER DEFAULT 1, Attr TEXT DEFAULT 'UNKNOWN', Val TEXT DEFAULT 'UNKNOWN', Typ TEXT DEFAULT 'UNKNOWN', UNIQUE(ObjId,Attr));", tb)
-	_, err = db.Db.Exec(schema)
+	var schema = db.Dialect().CreateTb(Ident(tb))
+	_, err = db.x().ExecContext(ctx, schema)
+	return queryError(Ident(tb), schema, err)
+}
+
+// DropTb 刪除表格，ObjId 的號碼也從頭開始，不存在仍返回成功
+func (db *Db) DropTb(tb string) error {
+	return db.DropTbCtx(context.Background(), tb)
+}
+
+func (db *Db) DropTbCtx(ctx context.Context, tb string) error {
+	if _, err := ParseIdent(tb); err != nil {
+		return err
+	}
+	var dropSql = fmt.Sprintf("DROP TABLE IF EXISTS %s;", tb)
+	if _, err := db.x().ExecContext(ctx, dropSql); err != nil {
+		return queryError(Ident(tb), dropSql, err)
+	}
+	return db.resetSeq(ctx, Ident(tb))
+}
+
+// CreateIndex 替某個屬性建立索引, GetsByFilter()/GetsWhere()/GetsByRange() 對該屬性的等於與範圍比對就不必掃過整個表格
+// sqlite3/postgres 是只包含該屬性的部分索引，另外還有數字(與時間)比大小用的運算式索引，
+// MySQL 則是所有屬性共用的 (Attr, Val) 索引 ix_AttrVal, 只加快等於比對，範圍比對(GetsByRange(), Gt() 等)
+// 要先把 Val 轉型，永遠用不到它. 已存在仍返回成功
+func (db *Db) CreateIndex(tb, attr string) error {
+	return db.CreateIndexCtx(context.Background(), tb, attr)
+}
+
+func (db *Db) CreateIndexCtx(ctx context.Context, tb, attr string) error {
+	name, err := ParseIdent(tb)
 	if err != nil {
-		if !strings.Contains(err.Error(), "already exists") {
-			return fmt.Errorf("%s\n\t%s", err.Error(), schema)
+		return err
+	}
+	for _, sql := range db.Dialect().CreateIndex(name, attr) {
+		_, err = db.x().ExecContext(ctx, sql)
+		if err != nil && !strings.Contains(err.Error(), "Duplicate key name") { // MySQL 沒有 IF NOT EXISTS
+			return queryError(name, sql, err)
+		}
+	}
+	return nil
+}
+
+// DropIndex 刪除 CreateIndex() 建立的索引
+func (db *Db) DropIndex(tb, attr string) error {
+	return db.DropIndexCtx(context.Background(), tb, attr)
+}
+
+func (db *Db) DropIndexCtx(ctx context.Context, tb, attr string) error {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return err
+	}
+	for _, sql := range db.Dialect().DropIndex(name, attr) {
+		if _, err = db.x().ExecContext(ctx, sql); err != nil {
+			return queryError(name, sql, err)
 		}
 	}
 	return nil
 }
 
 func (db *Db) MaxId(tb string) int {
+	return db.MaxIdCtx(context.Background(), tb)
+}
+
+func (db *Db) MaxIdCtx(ctx context.Context, tb string) int {
+	if _, err := ParseIdent(tb); err != nil {
+		return -1
+	}
 	// 找出目前筆數，以防止在找 ObjId 時出錯
 	count := 0
 	sql := "SELECT COUNT(ObjId) from "+tb+";"
-	if err := db.Db.Get(&count, sql); err != nil {
+	if err := sqlx.GetContext(ctx, db.x(), &count, sql); err != nil {
 		return -1
 	}
 
@@ -80,54 +178,37 @@ func (db *Db) MaxId(tb string) int {
 	objId := 0
 	if count > 0 {
 		sql = "SELECT MAX(ObjId) from "+tb+";"
-		if err := db.Db.Get(&objId, sql); err != nil {
+		if err := sqlx.GetContext(ctx, db.x(), &objId, sql); err != nil {
 			return -1
 		}
 	}
 	return objId
 }
 
+// NextId 只是參考用，兩個 goroutine 可能拿到同一個號碼，
+// Insert 系列是在交易內用 allocId() 配置 ObjId, 不會撞號
 func (db *Db) NextId(tb string) int {
-	return db.MaxId(tb) + 1
+	return db.NextIdCtx(context.Background(), tb)
+}
+
+func (db *Db) NextIdCtx(ctx context.Context, tb string) int {
+	return db.MaxIdCtx(ctx, tb) + 1
 }
 
 // 相當於 GetsByFilter(tb, "ObjId="+id)
 // 當然這邊的特定函式效率高
+// 出錯或找不到時傳回空的 map, 需要分辨原因請用 Find()
 func (db *Db) Get(tb string, id int) map[string]interface{} {
-	data := []Table{}
-	res := map[string]interface{}{}
-	sql := fmt.Sprintf(`SELECT * FROM %s WHERE ObjId=%d;`, tb, id)
-	err := db.Db.Select(&data, sql)
+	return db.GetCtx(context.Background(), tb, id)
+}
+
+func (db *Db) GetCtx(ctx context.Context, tb string, id int) map[string]interface{} {
+	res, err := db.FindCtx(ctx, tb, id)
 	if err != nil {
-		fmt.Printf("database.Get(%d) %s\n\terr: %s\n", id, sql, err.Error())
-		return res
-	}
-
-	if len(data) == 0 {
-		return res
-	}
-	res["Id"] = data[0].ObjId
-	for _,d := range data {
-		switch d.Typ {
-		case "int", "int64":
-			v,_ := strconv.Atoi(d.Val)
-			res[d.Attr] = v
-		case "bool":
-			res[d.Attr] = d.Val == "true"
-		case "string":
-			res[d.Attr] = d.Val
-		case "Time", "time.Time":
-			v := strings.ReplaceAll(d.Val, " +0000 UTC", "")
-			tt,err := time.Parse("2006-01-02 03:04:05", v)
-			if err != nil {
-				fmt.Printf("Format: %s\n", err.Error())
-			} else {
-				res[d.Attr] = (t.Time)(tt)
-			}
-		default: // 需要處理別種型態，例如 nil
-			//fmt.Printf("Get(%s,%d) catch wrong Typ '%v' with Val '%v'\n", tb, id, d.Typ, d.Val)
-			res[d.Attr] = d.Val
+		if !errors.Is(err, ErrNotFound) {
+			db.logf("database.Get(%d) %s\n", id, err.Error())
 		}
+		return map[string]interface{}{}
 	}
 	return res
 }
@@ -135,141 +216,370 @@ func (db *Db) Get(tb string, id int) map[string]interface{} {
 // 只有 Gets() 有個 checkVer 參數，而 Get()/GetsBy() 兩個都沒有 checkVer，原因是
 //  Gets() 有機會用在取得 system config 資料表，而
 //  Get()/GetsBy() 只用來取得特定資料，通常非 system config 應用
+// 出錯時傳回 nil, 需要錯誤請用 FindAll()
 func (db *Db) Gets(tb string) []map[string]interface{} {
-	data := []Table{}
-	sql := ""
-	sql = fmt.Sprintf(`SELECT * FROM %s ORDER BY ObjId;`, tb)
-	err := db.Db.Select(&data, sql)
+	return db.GetsCtx(context.Background(), tb)
+}
+
+func (db *Db) GetsCtx(ctx context.Context, tb string) []map[string]interface{} {
+	res, err := db.FindAllCtx(ctx, tb)
 	if err != nil {
-		fmt.Printf("database.Gets() %s\n\terr: %s\n", sql, err.Error())
+		db.logf("database.Gets() %s\n", err.Error())
 		return nil
 	}
-
-	res := []map[string]interface{}{}
-	if len(data) == 0 {
-		return res
-	}
-	r := map[string]interface{}{}
-	oid := 0
-	for _,d := range data {
-		if d.ObjId != oid { // 新的資料
-			if len(r) > 0 {
-				res = append(res, r)
-				r = map[string]interface{}{}
-				oid = d.ObjId
-			}
-		}
-		if oid == 0 {
-			oid = d.ObjId
-		}
-		r["Id"] = d.ObjId
-		switch d.Typ {
-		case "int", "int64":
-			v,_ := strconv.Atoi(d.Val)
-			r[d.Attr] = v
-		case "bool":
-			r[d.Attr] = d.Val == "true"
-		case "string":
-			r[d.Attr] = d.Val
-		case "Time":
-			v := strings.ReplaceAll(d.Val, " +0000 UTC", "")
-			tt,err := time.Parse("2006-01-02 03:04:05", v)
-			if err != nil {
-				fmt.Printf("Format: %s\n", err.Error())
-			} else {
-				r[d.Attr] = (t.Time)(tt)
-			}
-		default: // 需要處理別種型態，例如 nil
-			// fmt.Printf("Get(%s,%d) catch wrong Typ '%v' with Val '%v'\n", tb, oid, d.Typ, d.Val)
-			r[d.Attr] = d.Val
-		}
-	}
-	res = append(res, r)
 	return res
 }
 
 // 用來過濾欄位, 例如 IsGroup = true, 可以指定欄位的值, 如:
-// GetsByFilter("term", `Attr="IsGroup" AND Val="false"`)
+// GetsByFilter("term", `Attr=? AND Val=?`, "IsGroup", "false")
 // 原先有設計 GetsByField(), 後來併入 GetsByFilter(), 
-//   主要是因為後者比較有彈性，可以像 1<=ObjId AND ObjId<=10 AND Attr="..." 這樣的複式條件
-// 注意: 多欄位要使用 subquery，單一的呼叫 GetsByFilter() 目前做不到，橫式比較好做
-func (db *Db)GetsByFilter(tb, filter string) []map[string]interface{} {
-	data := []Table{}
-	sql := fmt.Sprintf(`SELECT * FROM %s WHERE ObjId IN (SELECT ObjId FROM %s WHERE %s) ORDER BY ObjId;`,
-		tb, tb, filter)
-	err := db.Db.Select(&data, sql)
+//   主要是因為後者比較有彈性，可以像 1<=ObjId AND ObjId<=10 AND Attr=? 這樣的複式條件
+// 注意: filter 會原封不動組進 SQL, 使用者給的值一律要用 ? 搭配 args 傳入，不要自己拼字串
+// 注意: 多欄位要使用 subquery，單一的呼叫 GetsByFilter() 目前做不到，橫式比較好做(見 CreatePivotView()), 或改用 GetsWhere()
+// 出錯時傳回 nil, 需要錯誤請用 FindByFilter()
+func (db *Db)GetsByFilter(tb, filter string, args ...interface{}) []map[string]interface{} {
+	return db.GetsByFilterCtx(context.Background(), tb, filter, args...)
+}
+
+func (db *Db) GetsByFilterCtx(ctx context.Context, tb, filter string, args ...interface{}) []map[string]interface{} {
+	res, err := db.FindByFilterCtx(ctx, tb, filter, args...)
 	if err != nil {
-		fmt.Printf("database.GetsByFilter() %s\n\terr: %s\n", sql, err.Error())
+		db.logf("database.GetsByFilter() %s\n", err.Error())
 		return nil
 	}
-	res := []map[string]interface{}{}
-	r := map[string]interface{}{}
-	oid := 0
-	for _,d := range data {
-		if d.ObjId != oid { // 新的資料
-			if len(r) > 0 { // 已經有 r 值
-				res = append(res, r)
-				r = map[string]interface{}{}
-				oid = d.ObjId
-			}
-		}
-		if oid == 0 {
-			oid = d.ObjId
-		}
-		r["Id"] = d.ObjId
-		switch d.Typ {
-		case "int", "int64":
-			v,_ := strconv.Atoi(d.Val)
-			r[d.Attr] = v
-		case "bool":
-			r[d.Attr] = d.Val == "true"
-		case "string":
-			r[d.Attr] = d.Val
-		case "Time":
-			v := strings.ReplaceAll(d.Val, " +0000 UTC", "")
-			tt,err := time.Parse("2006-01-02 03:04:05", v)
-			if err != nil {
-				fmt.Printf("Format: %s\n", err.Error())
-			} else {
-				r[d.Attr] = (t.Time)(tt)
-				fmt.Printf("%v: %+v\n", d.Attr, r[d.Attr])
-			}
-		default: // 需要處理別種型態，例如 nil
-			// fmt.Printf("Get(%s,%d) catch wrong Typ '%v' with Val '%v'\n", tb, oid, d.Typ, d.Val)
-			r[d.Attr] = d.Val
-		}
+	return res
+}
+
+// GetsWhere 用 Filter 過濾，可以同時對多個欄位下條件，例如:
+// GetsWhere("term", Attr("IsGroup").Eq(false).And(Attr("Age").Gt(30)))
+// 傳回的格式跟 Gets() 相同, 出錯時傳回 nil, 需要錯誤請用 FindWhere()
+func (db *Db) GetsWhere(tb string, filter Filter) []map[string]interface{} {
+	return db.GetsWhereCtx(context.Background(), tb, filter)
+}
+
+func (db *Db) GetsWhereCtx(ctx context.Context, tb string, filter Filter) []map[string]interface{} {
+	res, err := db.FindWhereCtx(ctx, tb, filter)
+	if err != nil {
+		db.logf("database.GetsWhere() %s\n", err.Error())
+		return nil
 	}
-	res = append(res, r)
 	return res
 }
 
+// GetsByRange 找出 attr 介於 min 與 max 之間(包含) 的物件，相當於
+// GetsWhere(tb, Attr(attr).Between(min, max))
+// min/max 是數字或時間時，依 Typ 轉型後比較，"9" < "10"; 否則以字串比較
+// 出錯時傳回 nil, 需要錯誤請用 FindByRange()
+func (db *Db) GetsByRange(tb, attr string, min, max interface{}) []map[string]interface{} {
+	return db.GetsByRangeCtx(context.Background(), tb, attr, min, max)
+}
+
+func (db *Db) GetsByRangeCtx(ctx context.Context, tb, attr string, min, max interface{}) []map[string]interface{} {
+	res, err := db.FindByRangeCtx(ctx, tb, attr, min, max)
+	if err != nil {
+		db.logf("database.GetsByRange() %s\n", err.Error())
+		return nil
+	}
+	return res
+}
+
+// Find 同 Get(), 物件不存在時傳回 ErrNotFound
+func (db *Db) Find(tb string, id int) (map[string]interface{}, error) {
+	return db.FindCtx(context.Background(), tb, id)
+}
+
+func (db *Db) FindCtx(ctx context.Context, tb string, id int) (map[string]interface{}, error) {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return nil, err
+	}
+	var res map[string]interface{}
+	sql := fmt.Sprintf(`SELECT ObjId,Attr,Val,Typ FROM %s WHERE ObjId=? ORDER BY Id;`, name)
+	err = db.scanObjs(ctx, name, sql, []interface{}{id}, func(item map[string]interface{}) error {
+		res = item
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, fmt.Errorf("%s(%d): %w", name, id, ErrNotFound)
+	}
+	return res, nil
+}
+
+// FindAll 同 Gets()
+func (db *Db) FindAll(tb string) ([]map[string]interface{}, error) {
+	return db.FindAllCtx(context.Background(), tb)
+}
+
+func (db *Db) FindAllCtx(ctx context.Context, tb string) ([]map[string]interface{}, error) {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return nil, err
+	}
+	sql := fmt.Sprintf(`SELECT ObjId,Attr,Val,Typ FROM %s ORDER BY ObjId,Id;`, name)
+	return db.collect(ctx, name, sql, nil)
+}
+
+// FindByFilter 同 GetsByFilter()
+func (db *Db) FindByFilter(tb, filter string, args ...interface{}) ([]map[string]interface{}, error) {
+	return db.FindByFilterCtx(context.Background(), tb, filter, args...)
+}
+
+func (db *Db) FindByFilterCtx(ctx context.Context, tb, filter string, args ...interface{}) ([]map[string]interface{}, error) {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return nil, err
+	}
+	sql := fmt.Sprintf(`SELECT ObjId,Attr,Val,Typ FROM %s WHERE ObjId IN (SELECT ObjId FROM %s WHERE %s) ORDER BY ObjId,Id;`,
+		name, name, filter)
+	return db.collect(ctx, name, sql, args)
+}
+
+// FindWhere 同 GetsWhere()
+func (db *Db) FindWhere(tb string, filter Filter) ([]map[string]interface{}, error) {
+	return db.FindWhereCtx(context.Background(), tb, filter)
+}
+
+func (db *Db) FindWhereCtx(ctx context.Context, tb string, filter Filter) ([]map[string]interface{}, error) {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return nil, err
+	}
+	where, args := filter.where(db.Dialect(), name)
+	return db.FindByFilterCtx(ctx, tb, where, args...)
+}
+
+// FindByRange 同 GetsByRange()
+func (db *Db) FindByRange(tb, attr string, min, max interface{}) ([]map[string]interface{}, error) {
+	return db.FindByRangeCtx(context.Background(), tb, attr, min, max)
+}
+
+func (db *Db) FindByRangeCtx(ctx context.Context, tb, attr string, min, max interface{}) ([]map[string]interface{}, error) {
+	return db.FindWhereCtx(ctx, tb, Attr(attr).Between(min, max))
+}
+
+// ForEach 逐一讀出表格內的物件，每組好一個物件就呼叫一次 fn, 不會把整個表格讀進記憶體,
+// 適合很大的表格. fn 傳回 error 時會停止並傳回該 error
+// 注意 fn 執行時查詢還開著: sqlite3 沒有開 WAL 時，fn 在交易外寫入資料庫會被擋住而失敗(database is locked),
+// 要寫入的話先 FindAll() 讀完再寫
+func (db *Db) ForEach(tb string, fn func(item map[string]interface{}) error) error {
+	return db.ForEachCtx(context.Background(), tb, fn)
+}
+
+func (db *Db) ForEachCtx(ctx context.Context, tb string, fn func(item map[string]interface{}) error) error {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return err
+	}
+	sql := fmt.Sprintf(`SELECT ObjId,Attr,Val,Typ FROM %s ORDER BY ObjId,Id;`, name)
+	return db.scanObjs(ctx, name, sql, nil, fn)
+}
+
 // 相當於 DelsBy(tb, "Id", id, id)
 // 當然這邊的特定用途的效率較高
+// 開啟 EnableSoftDelete() 的表格只標記為已刪除, DelsBy() 也一樣
 func (db *Db) Del(tb string, id int) error {
-	sql := fmt.Sprintf(`DELETE FROM %s WHERE ObjId=%d;`, tb, id)
-	_,err := db.Db.Exec(sql)
+	return db.DelCtx(context.Background(), tb, id)
+}
+
+func (db *Db) DelCtx(ctx context.Context, tb string, id int) error {
+	name, err := ParseIdent(tb)
 	if err != nil {
-		fmt.Printf("database.Del() %s\n\terr: %s\n", sql, err.Error())
 		return err
 	}
+	if db.softDel.has(name) {
+		return db.softDelete(ctx, name, "ObjId=?", []interface{}{id})
+	}
+	return db.tracked(ctx, name, "ObjId=?", []interface{}{id}, func(db *Db) error {
+		sql := fmt.Sprintf(`DELETE FROM %s WHERE ObjId=?;`, name)
+		_, err := db.x().ExecContext(ctx, db.rebind(sql), id)
+		return queryError(name, sql, err)
+	})
+}
 
-	return nil
+// UnsetAttrs 刪除物件的某些屬性，物件本身與其他屬性不受影響
+func (db *Db) UnsetAttrs(tb string, id int, attrs ...string) error {
+	return db.UnsetAttrsCtx(context.Background(), tb, id, attrs...)
 }
 
+func (db *Db) UnsetAttrsCtx(ctx context.Context, tb string, id int, attrs ...string) error {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return err
+	}
+	return db.updateRows(ctx, name, id, nil, attrs, anyVersion)
+}
+
+// DelsBy 刪除 field 介於 min 與 max 之間(包含) 的物件, field 為 "Id" 或 "ObjId" 時比對 ObjId,
+// 其他屬性依 Typ 轉成數字比較，不是數字的屬性不會被刪除
 func (db *Db) DelsBy(tb, field string, min, max int) error {
-	sql := ""
-	if field == "Id" || field == "ObjId" {
-		sql = fmt.Sprintf(`DELETE FROM %s WHERE %d<=ObjId AND ObjId<=%d;`,
-			tb, min, max)
-	} else {
-		sql = fmt.Sprintf(`DELETE FROM %s WHERE ObjId IN (SELECT ObjId FROM %s WHERE Attr="%s" AND %d<=Val AND Val<=%d);`,
-		tb, tb, field, min, max)
-	}
-	_,err := db.Db.Exec(sql)
+	return db.DelsByCtx(context.Background(), tb, field, min, max)
+}
+
+func (db *Db) DelsByCtx(ctx context.Context, tb, field string, min, max int) error {
+	name, err := ParseIdent(tb)
 	if err != nil {
-		fmt.Printf("database.DelsBy() %s\n\terr: %s\n", sql, err.Error())
 		return err
 	}
+	where, args := Attr(field).Between(min, max).where(db.Dialect(), name)
+	if db.softDel.has(name) {
+		return db.softDelete(ctx, name, where, args)
+	}
+	return db.tracked(ctx, name, where, args, func(db *Db) error {
+		sql := db.Dialect().Delete(name, where)
+		_, err := db.x().ExecContext(ctx, db.rebind(sql), args...)
+		return queryError(name, sql, err)
+	})
+}
 
+// insertRows 用 bound placeholder 把多筆 Table 一次 INSERT 進去, 只看 ObjId/Attr/Val/Typ
+func (db *Db) insertRows(ctx context.Context, tb Ident, rows []Table) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	where, wargs := objsWhere(rows)
+	return db.tracked(ctx, tb, where, wargs, func(db *Db) error {
+		sql := insertSql(tb, len(rows)) + ";"
+		args := make([]interface{}, 0, len(rows)*4)
+		for _, r := range rows {
+			args = append(args, r.ObjId, r.Attr, r.Val, r.Typ)
+		}
+		_, err := db.x().ExecContext(ctx, db.rebind(sql), args...)
+		return queryError(tb, sql, err)
+	})
+}
+
+// upsertRows 用一個 INSERT ... ON CONFLICT(ObjId,Attr) DO UPDATE 寫入多筆 Table,
+// 已存在的屬性改成新的 Val/Typ, 不存在的就新增, 靠的是 CreateTb() 建立的 UNIQUE(ObjId,Attr)
+func (db *Db) upsertRows(ctx context.Context, tb Ident, rows []Table) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	where, wargs := objsWhere(rows)
+	return db.tracked(ctx, tb, where, wargs, func(db *Db) error {
+		sql := db.Dialect().Upsert(tb, len(rows))
+		args := make([]interface{}, 0, len(rows)*4)
+		for _, r := range rows {
+			args = append(args, r.ObjId, r.Attr, r.Val, r.Typ)
+		}
+		_, err := db.x().ExecContext(ctx, db.rebind(sql), args...)
+		return queryError(tb, sql, err)
+	})
+}
+
+// updateRows 檢查 Schema 後寫入 rows, 並刪除 unset 這些屬性, Version 加 1
+// expected 不是 anyVersion 時，Version 必須等於 expected, 見 UpdateIfVersion()
+func (db *Db) updateRows(ctx context.Context, tb Ident, objId int, rows []Table, unset []string, expected int) error {
+	return db.atomic(ctx, func(db *Db) error {
+		if err := db.bumpVersion(ctx, tb, objId, expected); err != nil {
+			return err
+		}
+		rows, err := db.checkSchema(ctx, tb, objId, rows, unset, false)
+		if err != nil {
+			return err
+		}
+		if err := db.upsertRows(ctx, tb, dropVersion(rows)); err != nil {
+			return err
+		}
+		attrs := make([]string, 0, len(unset))
+		for _, attr := range unset {
+			if attr != VersionAttr {
+				attrs = append(attrs, attr)
+			}
+		}
+		return db.unsetAttrs(ctx, tb, objId, attrs)
+	})
+}
+
+// unsetAttrs 刪除 objId 的 attrs 這些屬性
+func (db *Db) unsetAttrs(ctx context.Context, tb Ident, objId int, attrs []string) error {
+	if len(attrs) == 0 {
+		return nil
+	}
+	return db.tracked(ctx, tb, "ObjId=?", []interface{}{objId}, func(db *Db) error {
+		sql := fmt.Sprintf(`DELETE FROM %s WHERE ObjId=? AND Attr IN (?%s);`, tb, strings.Repeat(",?", len(attrs)-1))
+		args := make([]interface{}, 0, len(attrs)+1)
+		args = append(args, objId)
+		for _, attr := range attrs {
+			args = append(args, attr)
+		}
+		_, err := db.x().ExecContext(ctx, db.rebind(sql), args...)
+		return queryError(tb, sql, err)
+	})
+}
+
+// collect 將 scanObjs() 組好的物件收集起來
+func (db *Db) collect(ctx context.Context, tb Ident, sql string, args []interface{}) ([]map[string]interface{}, error) {
+	res := []map[string]interface{}{}
+	err := db.scanObjs(ctx, tb, sql, args, func(item map[string]interface{}) error {
+		res = append(res, item)
+		return nil
+	})
+	return res, err
+}
+
+// scanObjs 是所有讀取 API 共用的組裝流程:
+// 逐筆讀取 ObjId,Attr,Val,Typ, 依 Typ 還原 Val, 同一個 ObjId 的屬性組成一個物件後交給 fn
+// sql 必須 ORDER BY ObjId, 這樣同一個物件的資料才會連在一起
+// Query 與讀取時的錯誤包成 *QueryError, fn 傳回的 error 則原封不動
+// 開啟 EnableSoftDelete() 的表格，已刪除的物件不會交給 fn, 除非是 IncludeDeleted()
+// Schema.Model 有 AfterLoad 時，先呼叫再交給 fn
+func (db *Db) scanObjs(ctx context.Context, tb Ident, sql string, args []interface{}, fn func(item map[string]interface{}) error) error {
+	if model := db.hooked(tb, afterLoaderType); model != nil { // 見 hooks.go
+		next := fn
+		fn = func(item map[string]interface{}) error {
+			item, _, err := mapHooks(model, nil, item, func(obj interface{}) error {
+				return afterLoad(ctx, obj)
+			})
+			if err != nil {
+				return err
+			}
+			return next(item)
+		}
+	}
+	if db.hidesDeleted(tb) { // 包在外層，先略過已刪除的物件，不會對它們呼叫 AfterLoad
+		next := fn
+		fn = func(item map[string]interface{}) error {
+			if _, deleted := item[Tombstone]; deleted {
+				return nil
+			}
+			return next(item)
+		}
+	}
+	rows, err := db.x().QueryxContext(ctx, db.rebind(sql), args...)
+	if err != nil {
+		return queryError(tb, sql, err)
+	}
+	defer rows.Close()
+
+	var item map[string]interface{}
+	oid := 0
+	for rows.Next() {
+		d := Table{}
+		if err := rows.StructScan(&d); err != nil {
+			return queryError(tb, sql, err)
+		}
+		if item == nil || d.ObjId != oid { // 新的資料
+			if item != nil {
+				if err := fn(item); err != nil {
+					return err
+				}
+			}
+			item = map[string]interface{}{"Id": d.ObjId}
+			oid = d.ObjId
+		}
+		if d.Attr == "Id" { // 舊資料可能存了 Id 欄位, 以 ObjId 為準
+			continue
+		}
+		item[d.Attr] = decodeAttr(d.Typ, d.Val)
+	}
+	if err := rows.Err(); err != nil {
+		return queryError(tb, sql, err)
+	}
+	if item != nil {
+		return fn(item)
+	}
 	return nil
 }
@@ -0,0 +1,72 @@
+package database
+
+// 讀取 API 原本出錯時只會印出訊息再傳回空的結果，呼叫端分不出是「找不到」還是「SQL 失敗」,
+// 所以 Find 系列會傳回 error:
+//   ErrNotFound    物件不存在
+//   ErrNoSuchTable 表格不存在 (用 errors.Is 判斷)
+//   *QueryError    其他 SQL 錯誤，帶有表格名稱與 SQL (用 errors.As 取出)
+// UpdateIfVersion() 版本不符時傳回 *ConflictError, 用 errors.Is(err, ErrConflict) 判斷
+// 原本的 Get 系列保留，出錯時交給 Db.Logger 記錄
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+var (
+	ErrNotFound    = errors.New("database: not found")
+	ErrNoSuchTable = errors.New("database: no such table")
+	ErrConflict    = errors.New("database: version conflict")
+)
+
+// QueryError 是執行 SQL 失敗時傳回的錯誤
+type QueryError struct {
+	Table string
+	SQL   string
+	Err   error
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%s\n\t%s", e.Err.Error(), e.SQL)
+}
+
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// Is 讓 errors.Is(err, ErrNoSuchTable) 可以判斷各家資料庫的「表格不存在」
+func (e *QueryError) Is(target error) bool {
+	if target != ErrNoSuchTable {
+		return false
+	}
+	msg := e.Err.Error()
+	return strings.Contains(msg, "no such table") || // sqlite3
+		strings.Contains(msg, "doesn't exist") || // mysql
+		(strings.Contains(msg, "relation") && strings.Contains(msg, "does not exist")) // postgres
+}
+
+func queryError(tb Ident, sql string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &QueryError{Table: string(tb), SQL: sql, Err: err}
+}
+
+// Logger 只要有 Printf 就可以，例如 *log.Logger
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+var stdLogger Logger = log.New(os.Stdout, "", 0)
+
+// logf 沒有設定 Db.Logger 時，跟以前一樣印到 stdout
+func (db *Db) logf(format string, v ...interface{}) {
+	if db.Logger != nil {
+		db.Logger.Printf(format, v...)
+		return
+	}
+	stdLogger.Printf(format, v...)
+}
@@ -0,0 +1,280 @@
+package database
+
+// 其他地方需要知道資料變了(例如更新快取), 可以訂閱表格的變動:
+//   cancel, err := db.Subscribe("member", func(e database.Event) {
+//       fmt.Println(e.Op, e.ObjId, e.Attrs, e.Old, e.New)
+//   })
+//   defer cancel()
+//   ch, cancel, err := db.SubscribeChan("member", 100) // 用 channel 接收，不會卡住寫入的 goroutine
+// 事件在 commit 之後才送出，rollback 的變動不會有事件
+// 同一個交易內對同一個物件的多次變動合併成一個事件，例如 Insert 後再 Update 只有一個 EventInsert
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// EventOp 事件的種類
+type EventOp string
+
+const (
+	EventInsert EventOp = "insert"
+	EventUpdate EventOp = "update"
+	EventDelete EventOp = "delete" // 開啟 EnableSoftDelete() 的表格也是 EventDelete, New 會有 DeletedAt
+)
+
+// Event 是一個物件的變動
+type Event struct {
+	Table string
+	Op    EventOp
+	ObjId int
+	Attrs []string               // 有變動的屬性，依名稱排序
+	Old   map[string]interface{} // Attrs 變動前的值，原本沒有的屬性不在 map 裡
+	New   map[string]interface{} // Attrs 變動後的值，被刪除的屬性不在 map 裡
+}
+
+// subscriber 一個訂閱, 取消之後不再送出
+type subscriber struct {
+	fn     func(Event)
+	closed int32
+}
+
+func (s *subscriber) send(e Event) {
+	if atomic.LoadInt32(&s.closed) == 0 {
+		s.fn(e)
+	}
+}
+
+// subscribers 各表格的訂閱
+type subscribers struct {
+	mu sync.RWMutex
+	m  map[Ident][]*subscriber
+}
+
+func newSubscribers() *subscribers {
+	return &subscribers{m: map[Ident][]*subscriber{}}
+}
+
+func (s *subscribers) add(tb Ident, sub *subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m[tb] = append(s.m[tb], sub)
+}
+
+func (s *subscribers) remove(tb Ident, sub *subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := s.m[tb]
+	for i, x := range list {
+		if x == sub {
+			s.m[tb] = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(s.m[tb]) == 0 {
+		delete(s.m, tb)
+	}
+}
+
+// list 傳回 tb 目前的訂閱，自己建立的 Db{Db: ...} 沒有 subscribers, 一律是 nil
+func (s *subscribers) list(tb Ident) []*subscriber {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.m[tb]
+}
+
+func (s *subscribers) has(tb Ident) bool {
+	return len(s.list(tb)) > 0
+}
+
+// Subscribe 在 tb 的變動 commit 之後呼叫 fn, 傳回取消訂閱的函式
+// fn 在執行 commit 的 goroutine 內依序呼叫，不要做太久的事，也不要在 fn 內寫入同一個表格
+func (db *Db) Subscribe(tb string, fn func(Event)) (cancel func(), err error) {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return nil, err
+	}
+	if db.subs == nil {
+		db.subs = newSubscribers()
+	}
+	sub := &subscriber{fn: fn}
+	db.subs.add(name, sub)
+	subs := db.subs
+	return func() {
+		subs.remove(name, sub)
+		atomic.StoreInt32(&sub.closed, 1)
+	}, nil
+}
+
+// SubscribeChan 同 Subscribe(), 但事件送到大小為 size 的 channel, 取消訂閱時關閉 channel
+// channel 滿了的時候丟掉事件並記錄在 Db.Logger, 不會卡住寫入
+func (db *Db) SubscribeChan(tb string, size int) (<-chan Event, func(), error) {
+	ch := make(chan Event, size)
+	mu, closed := sync.Mutex{}, false // 正在送出時不能關閉 channel
+	cancel, err := db.Subscribe(tb, func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case ch <- e:
+		default:
+			db.logf("Subscribe(%s): channel full, drop %s event of ObjId %d", e.Table, e.Op, e.ObjId)
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return ch, func() {
+		cancel()
+		mu.Lock()
+		defer mu.Unlock()
+		if !closed {
+			closed = true
+			close(ch)
+		}
+	}, nil
+}
+
+// change 是 tracked() 記錄的一次變動，op 為 "" 表示依前後資料判斷
+type change struct {
+	tb            Ident
+	op            EventOp
+	before, after map[attrKey]Table
+}
+
+// eventBuf 交易內還沒送出的變動，savepoint 成功時併到外層，失敗時丟掉
+type eventBuf struct {
+	changes []change
+}
+
+func (b *eventBuf) add(cs ...change) {
+	if b != nil {
+		b.changes = append(b.changes, cs...)
+	}
+}
+
+// publish commit 之後把 buf 的變動合併成事件送給訂閱者
+func (db *Db) publish(buf *eventBuf) {
+	if buf == nil || len(buf.changes) == 0 {
+		return
+	}
+	for _, e := range buf.events() {
+		for _, sub := range db.subs.list(Ident(e.Table)) {
+			sub.send(e)
+		}
+	}
+}
+
+// pendingEvent 合併中的事件, old/new 為 nil 表示沒有這個屬性
+type pendingEvent struct {
+	tb               Ident
+	objId            int
+	created, deleted bool
+	old, new         map[string]*Table
+}
+
+// events 把變動依物件合併成事件，依物件第一次變動的順序排列
+func (b *eventBuf) events() []Event {
+	type key struct {
+		tb    Ident
+		objId int
+	}
+	order := []*pendingEvent{}
+	pending := map[key]*pendingEvent{}
+	for _, c := range b.changes {
+		byObj := map[int][]attrKey{}
+		for _, m := range []map[attrKey]Table{c.before, c.after} {
+			for k := range m {
+				byObj[k.ObjId] = append(byObj[k.ObjId], k)
+			}
+		}
+		ids := make([]int, 0, len(byObj))
+		for id := range byObj {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			op := c.op
+			if op == "" {
+				op = objOp(c, byObj[id])
+			}
+			p := pending[key{c.tb, id}]
+			if p == nil {
+				p = &pendingEvent{tb: c.tb, objId: id, created: op == EventInsert, old: map[string]*Table{}, new: map[string]*Table{}}
+				pending[key{c.tb, id}] = p
+				order = append(order, p)
+			}
+			p.deleted = op == EventDelete
+			for _, k := range byObj[id] {
+				if _, ok := p.old[k.Attr]; !ok {
+					p.old[k.Attr] = rowOf(c.before, k)
+				}
+				p.new[k.Attr] = rowOf(c.after, k)
+			}
+		}
+	}
+
+	res := make([]Event, 0, len(order))
+	for _, p := range order {
+		e := Event{Table: string(p.tb), Op: EventUpdate, ObjId: p.objId, Old: map[string]interface{}{}, New: map[string]interface{}{}}
+		switch {
+		case p.created && p.deleted: // 交易內新增又刪除
+			continue
+		case p.created:
+			e.Op = EventInsert
+		case p.deleted:
+			e.Op = EventDelete
+		}
+		for attr, old := range p.old {
+			r := p.new[attr]
+			same := old == nil && r == nil || old != nil && r != nil && old.Val == r.Val && old.Typ == r.Typ
+			if same {
+				continue
+			}
+			e.Attrs = append(e.Attrs, attr)
+			if old != nil {
+				e.Old[attr] = decodeAttr(old.Typ, old.Val)
+			}
+			if r != nil {
+				e.New[attr] = decodeAttr(r.Typ, r.Val)
+			}
+		}
+		if len(e.Attrs) == 0 && e.Op == EventUpdate {
+			continue
+		}
+		sort.Strings(e.Attrs)
+		res = append(res, e)
+	}
+	return res
+}
+
+// objOp 依物件在 c 前後有沒有資料判斷種類，where 必須涵蓋整個物件
+func objOp(c change, keys []attrKey) EventOp {
+	inBefore, inAfter := false, false
+	for _, k := range keys {
+		_, ok := c.before[k]
+		inBefore = inBefore || ok
+		_, ok = c.after[k]
+		inAfter = inAfter || ok
+	}
+	switch {
+	case !inBefore:
+		return EventInsert
+	case !inAfter:
+		return EventDelete
+	}
+	return EventUpdate
+}
+
+func rowOf(m map[attrKey]Table, k attrKey) *Table {
+	if r, ok := m[k]; ok {
+		return &r
+	}
+	return nil
+}
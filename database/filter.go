@@ -0,0 +1,234 @@
+package database
+
+// 直式表格要對多個欄位下條件，每個條件都要變成一個子查詢:
+//   ObjId IN (SELECT ObjId FROM tb WHERE Attr=? AND Val=?)
+// 再用 AND/OR/NOT 串起來，手寫很容易出錯，這邊提供組合用的 Filter, 例如:
+//   db.GetsWhere("term", Attr("IsGroup").Eq(false).And(Attr("Age").Gt(30)))
+//   db.GetsWhere("term", ObjId().Between(1, 10).And(Not(Attr("Name").Like("A%"))))
+// 所有的值都透過 placeholder 綁定，不會組進 SQL 字串
+// Val 是字串，"10" < "9", 所以 Gt/Ge/Lt/Le/Between 給的值是數字或時間時，
+// 會依 Typ 把 Val 轉成數字或時間再比較(見 typedVal()), Typ 不是數字或時間的物件不會符合
+// 數字以浮點數比較，超過 2^53 的整數可能不精確
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	t "dbx/time"
+)
+
+// Filter 是一個可以組合的查詢條件，零值代表不過濾
+type Filter struct {
+	build func(d Dialect, tb Ident) (string, []interface{})
+}
+
+// Field 代表一個欄位，Attr 為 "Id" 或 "ObjId" 時直接比對 ObjId
+type Field struct {
+	name string
+}
+
+// Attr 指定要比對的屬性
+func Attr(name string) Field {
+	return Field{name: name}
+}
+
+// ObjId 相當於 Attr("ObjId")
+func ObjId() Field {
+	return Field{name: "ObjId"}
+}
+
+func (a Field) isId() bool {
+	return a.name == "Id" || a.name == "ObjId"
+}
+
+// cond 產生單一欄位的條件, expr 是對 Val (或 ObjId) 的比較式, 例如 "=?"
+// 比對 Val 時，vs 會先轉成跟寫入時相同的字串
+func (a Field) cond(expr string, vs ...interface{}) Filter {
+	return Filter{build: func(d Dialect, tb Ident) (string, []interface{}) {
+		if a.isId() {
+			return "ObjId" + expr, vs
+		}
+		args := []interface{}{a.name}
+		for _, v := range vs {
+			args = append(args, filterVal(v))
+		}
+		sql := fmt.Sprintf("ObjId IN (SELECT ObjId FROM %s WHERE Attr=? AND Val%s)", tb, expr)
+		return sql, args
+	}}
+}
+
+// rangeCond 比大小用，vs 都是數字或都是時間時，Val 依 Typ 轉型後再比較，否則同 cond()
+func (a Field) rangeCond(expr string, vs ...interface{}) Filter {
+	kind := valKind(vs)
+	if a.isId() || kind == "" {
+		return a.cond(expr, vs...)
+	}
+	return Filter{build: func(d Dialect, tb Ident) (string, []interface{}) {
+		args := []interface{}{a.name}
+		for _, v := range vs {
+			args = append(args, typedArg(kind, v))
+		}
+		e := expr // Filter 可以重複使用，不能改到 expr
+		if kind == "time" {
+			e = strings.Replace(e, "?", d.Typed("?", kind), -1)
+		}
+		sql := fmt.Sprintf("ObjId IN (SELECT ObjId FROM %s WHERE Attr=? AND %s%s)", tb, typedVal(d, kind), e)
+		return sql, args
+	}}
+}
+
+func (a Field) Eq(v interface{}) Filter { return a.cond("=?", v) }
+func (a Field) Ne(v interface{}) Filter { return a.cond("<>?", v) }
+func (a Field) Gt(v interface{}) Filter { return a.rangeCond(">?", v) }
+func (a Field) Ge(v interface{}) Filter { return a.rangeCond(">=?", v) }
+func (a Field) Lt(v interface{}) Filter { return a.rangeCond("<?", v) }
+func (a Field) Le(v interface{}) Filter { return a.rangeCond("<=?", v) }
+
+// Like 的 pattern 用 SQL 的 % 與 _
+func (a Field) Like(pattern string) Filter { return a.cond(" LIKE ?", pattern) }
+
+// Between 包含 min 與 max
+func (a Field) Between(min, max interface{}) Filter {
+	return a.rangeCond(" BETWEEN ? AND ?", min, max)
+}
+
+// In 沒有給任何值時，永遠不成立
+func (a Field) In(vs ...interface{}) Filter {
+	if len(vs) == 0 {
+		return Filter{build: func(d Dialect, tb Ident) (string, []interface{}) {
+			return "1=0", nil
+		}}
+	}
+	return a.cond(" IN (?"+strings.Repeat(",?", len(vs)-1)+")", vs...)
+}
+
+func (f Filter) And(fs ...Filter) Filter {
+	return join("AND", append([]Filter{f}, fs...))
+}
+
+func (f Filter) Or(fs ...Filter) Filter {
+	return join("OR", append([]Filter{f}, fs...))
+}
+
+func (f Filter) Not() Filter {
+	return Not(f)
+}
+
+// And 所有條件都成立
+func And(fs ...Filter) Filter {
+	return join("AND", fs)
+}
+
+// Or 任一條件成立
+func Or(fs ...Filter) Filter {
+	return join("OR", fs)
+}
+
+// Not 條件不成立, 注意 Not(Attr("A").Eq(1)) 也包含根本沒有 A 屬性的物件
+func Not(f Filter) Filter {
+	if f.build == nil {
+		return f
+	}
+	return Filter{build: func(d Dialect, tb Ident) (string, []interface{}) {
+		sql, args := f.build(d, tb)
+		return "NOT (" + sql + ")", args
+	}}
+}
+
+// join 把多個條件用 op 串起來，零值的 Filter 會被略過
+func join(op string, fs []Filter) Filter {
+	subs := []Filter{}
+	for _, f := range fs {
+		if f.build != nil {
+			subs = append(subs, f)
+		}
+	}
+	if len(subs) == 0 {
+		return Filter{}
+	}
+	if len(subs) == 1 {
+		return subs[0]
+	}
+	return Filter{build: func(d Dialect, tb Ident) (string, []interface{}) {
+		parts := make([]string, len(subs))
+		args := []interface{}{}
+		for i, f := range subs {
+			sql, a := f.build(d, tb)
+			parts[i] = sql
+			args = append(args, a...)
+		}
+		return "(" + strings.Join(parts, " "+op+" ") + ")", args
+	}}
+}
+
+// where 將 Filter 轉成 WHERE 後面的條件式
+func (f Filter) where(d Dialect, tb Ident) (string, []interface{}) {
+	if f.build == nil {
+		return "1=1", nil
+	}
+	return f.build(d, tb)
+}
+
+// filterVal 跟寫入時一樣，Val 都是以 encodeVal() 轉成的字串存放
+func filterVal(v interface{}) interface{} {
+	return encodeVal(v)
+}
+
+// 可以比大小的 Typ
+var (
+	numberTyps = []string{"int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64", "uintptr", "float32", "float64"}
+	timeTyps   = []string{"time.Time", "Time"}
+)
+
+// typedVal 把 Val 依 Typ 轉成數字("number") 或時間("time"), Typ 不符合時為 NULL, 比較結果一定不成立
+// 用 CASE 而不是 AND, 這樣 postgres 才不會對不是數字的 Val 做 CAST 而出錯
+// CreateIndex() 建立的運算式索引也用同一個式子，查詢時才會用到索引
+func typedVal(d Dialect, kind string) string {
+	typs := numberTyps
+	if kind == "time" {
+		typs = timeTyps
+	}
+	quoted := make([]string, len(typs))
+	for i, typ := range typs {
+		quoted[i] = d.Quote(typ)
+	}
+	return fmt.Sprintf("CASE WHEN Typ IN (%s) THEN %s END", strings.Join(quoted, ","), d.Typed("Val", kind))
+}
+
+// valKind vs 都是數字時傳回 "number", 都是時間時傳回 "time", 否則傳回 ""
+func valKind(vs []interface{}) string {
+	kind := ""
+	for _, v := range vs {
+		k := ""
+		switch v.(type) {
+		case time.Time, *time.Time, t.Time, *t.Time:
+			k = "time"
+		case json.Number:
+			k = "number"
+		default:
+			if _, ok := toFloat(v); ok {
+				k = "number"
+			}
+		}
+		if k == "" || (kind != "" && k != kind) {
+			return ""
+		}
+		kind = k
+	}
+	return kind
+}
+
+// typedArg 數字綁定成 float64, 時間則是跟寫入時相同的字串
+func typedArg(kind string, v interface{}) interface{} {
+	if kind == "time" {
+		return encodeVal(v)
+	}
+	if n, ok := v.(json.Number); ok {
+		f, _ := n.Float64()
+		return f
+	}
+	f, _ := toFloat(v)
+	return f
+}
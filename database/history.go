@@ -0,0 +1,345 @@
+package database
+
+// Update 會直接蓋掉 Val, 需要知道誰在什麼時候改了什麼的表格，可以開啟 history:
+//   err := db.EnableHistory("config")              // 建立 config_history, 之後每個屬性的變動都會記錄下來
+//   ctx := database.WithActor(ctx, "simba")        // 記錄是誰改的
+//   err = db.MapUpdateCtx(ctx, "config", input)
+//   changes, err := db.History("config", 1, "Port") // Port 的變動，attr = "" 表示所有屬性
+//   item, err := db.GetAsOf("config", 1, t)         // ObjId 1 在時間 t 的樣子
+// 記錄與寫入在同一個交易內，rollback 時記錄也不會留下來; 同一個交易的記錄時間都一樣
+// 開啟前就存在的值沒有記錄，GetAsOf() 會用該屬性第一筆記錄的舊值, 沒有任何記錄則是目前的值
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// histTime 記錄時間的格式，固定長度才能直接用字串比大小
+const histTime = "2006-01-02 15:04:05.000000000"
+
+// tableSet 開啟某種功能的表格，例如 EnableHistory()
+type tableSet struct {
+	mu sync.RWMutex
+	m  map[Ident]bool
+}
+
+func newTableSet() *tableSet {
+	return &tableSet{m: map[Ident]bool{}}
+}
+
+func (s *tableSet) set(tb Ident, on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if on {
+		s.m[tb] = true
+	} else {
+		delete(s.m, tb)
+	}
+}
+
+// has 自己建立的 Db{Db: ...} 沒有 tableSet, 一律是 false
+func (s *tableSet) has(tb Ident) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.m[tb]
+}
+
+// Change 是 History() 傳回的一筆變動, 屬性被刪除時 New 為 nil 且 Typ 為 ""
+type Change struct {
+	ObjId int
+	Attr  string
+	Old   interface{} // 變動前的值，原本沒有這個屬性時為 nil
+	New   interface{}
+	Typ   string // New 的 Typ
+	At    time.Time
+	Actor string // 見 WithActor()
+}
+
+// histRow 是 history 表格的一筆資料
+type histRow struct {
+	Id     int     `db:"Id"`
+	ObjId  int     `db:"ObjId"`
+	Attr   string  `db:"Attr"`
+	OldVal *string `db:"OldVal"`
+	OldTyp *string `db:"OldTyp"`
+	Val    *string `db:"Val"`
+	Typ    *string `db:"Typ"`
+	At     string  `db:"At"`
+	Actor  string  `db:"Actor"`
+}
+
+type actorKey struct{}
+
+// WithActor 在 ctx 記錄操作者，開啟 history 的表格會把它寫進記錄
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorOf 傳回 WithActor() 記錄的操作者，沒有則為 ""
+func ActorOf(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// historyTb 傳回 tb 的 history 表格名稱
+func historyTb(tb Ident) (Ident, error) {
+	return ParseIdent(string(tb) + "_history")
+}
+
+// EnableHistory 開始記錄 tb 每個屬性的變動，history 表格不存在則建立
+func (db *Db) EnableHistory(tb string) error {
+	return db.EnableHistoryCtx(context.Background(), tb)
+}
+
+func (db *Db) EnableHistoryCtx(ctx context.Context, tb string) error {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return err
+	}
+	hist, err := historyTb(name)
+	if err != nil {
+		return fmt.Errorf("EnableHistory(%s): table name too long", tb)
+	}
+	sql := db.Dialect().CreateHistory(hist)
+	if _, err := db.x().ExecContext(ctx, sql); err != nil {
+		return queryError(hist, sql, err)
+	}
+	if db.history == nil {
+		db.history = newTableSet()
+	}
+	db.history.set(name, true)
+	return nil
+}
+
+// DisableHistory 停止記錄, 已經有的記錄保留
+func (db *Db) DisableHistory(tb string) {
+	if db.history != nil {
+		db.history.set(Ident(tb), false)
+	}
+}
+
+// tracked 執行會改到 tb 的 fn, 開啟 history 或有 Subscribe() 時比對 fn 前後符合 where 的資料,
+// 記錄變動並產生事件，where 必須涵蓋 fn 會改到的所有資料, 事件種類依物件前後有沒有資料判斷
+func (db *Db) tracked(ctx context.Context, tb Ident, where string, args []interface{}, fn func(db *Db) error) error {
+	return db.trackedAs(ctx, tb, "", where, args, fn)
+}
+
+// trackedAs 同 tracked(), 但事件種類固定為 op, 給 where 不是涵蓋整個物件或軟刪除的操作使用
+func (db *Db) trackedAs(ctx context.Context, tb Ident, op EventOp, where string, args []interface{}, fn func(db *Db) error) error {
+	if !db.history.has(tb) && !db.subs.has(tb) {
+		return fn(db)
+	}
+	return db.atomic(ctx, func(db *Db) error {
+		before, err := db.snapshot(ctx, tb, where, args)
+		if err != nil {
+			return err
+		}
+		if err := fn(db); err != nil {
+			return err
+		}
+		after, err := db.snapshot(ctx, tb, where, args)
+		if err != nil {
+			return err
+		}
+		if db.subs.has(tb) {
+			db.events.add(change{tb: tb, op: op, before: before, after: after})
+		}
+		if !db.history.has(tb) {
+			return nil
+		}
+		if db.histAt.IsZero() { // 同一個交易的記錄用同一個時間，GetAsOf() 才不會看到只改了一半的物件
+			*db.histAt = time.Now()
+		}
+		return db.writeHistory(ctx, tb, before, after, ActorOf(ctx), *db.histAt)
+	})
+}
+
+// objsWhere 傳回涵蓋 rows 所有物件的 where
+func objsWhere(rows []Table) (string, []interface{}) {
+	args := []interface{}{}
+	seen := map[int]bool{}
+	for _, r := range rows {
+		if !seen[r.ObjId] {
+			seen[r.ObjId] = true
+			args = append(args, r.ObjId)
+		}
+	}
+	return fmt.Sprintf("ObjId IN (?%s)", strings.Repeat(",?", len(args)-1)), args
+}
+
+type attrKey struct {
+	ObjId int
+	Attr  string
+}
+
+// snapshot 讀出符合 where 的屬性
+func (db *Db) snapshot(ctx context.Context, tb Ident, where string, args []interface{}) (map[attrKey]Table, error) {
+	rows := []Table{}
+	sql := fmt.Sprintf("SELECT Id,ObjId,Attr,Val,Typ FROM %s WHERE %s;", tb, where)
+	if err := sqlx.SelectContext(ctx, db.x(), &rows, db.rebind(sql), args...); err != nil {
+		return nil, queryError(tb, sql, err)
+	}
+	res := make(map[attrKey]Table, len(rows))
+	for _, r := range rows {
+		res[attrKey{r.ObjId, r.Attr}] = r
+	}
+	return res, nil
+}
+
+// writeHistory 記錄 before 到 after 之間有變動的屬性，依 ObjId, Attr 排序
+func (db *Db) writeHistory(ctx context.Context, tb Ident, before, after map[attrKey]Table, actor string, at time.Time) error {
+	keys := []attrKey{}
+	for k, old := range before {
+		if r, ok := after[k]; !ok || r.Val != old.Val || r.Typ != old.Typ {
+			keys = append(keys, k)
+		}
+	}
+	for k := range after {
+		if _, ok := before[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].ObjId != keys[j].ObjId {
+			return keys[i].ObjId < keys[j].ObjId
+		}
+		return keys[i].Attr < keys[j].Attr
+	})
+
+	hist, _ := historyTb(tb)
+	stamp := at.UTC().Format(histTime)
+	const chunk = 100 // sqlite3 最多 999 個參數
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > chunk {
+			n = chunk
+		}
+		args := make([]interface{}, 0, n*8)
+		for _, k := range keys[:n] {
+			args = append(args, k.ObjId, k.Attr)
+			for _, m := range []map[attrKey]Table{before, after} {
+				if r, ok := m[k]; ok {
+					args = append(args, r.Val, r.Typ)
+				} else {
+					args = append(args, nil, nil)
+				}
+			}
+			args = append(args, stamp, actor)
+		}
+		sql := fmt.Sprintf("INSERT INTO %s (ObjId,Attr,OldVal,OldTyp,Val,Typ,At,Actor) VALUES %s;",
+			hist, strings.TrimSuffix(strings.Repeat("(?,?,?,?,?,?,?,?),", n), ","))
+		if _, err := db.x().ExecContext(ctx, db.rebind(sql), args...); err != nil {
+			return queryError(hist, sql, err)
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// History 傳回物件 id 的屬性 attr 的變動，依時間排序，attr = "" 表示所有屬性
+func (db *Db) History(tb string, id int, attr string) ([]Change, error) {
+	return db.HistoryCtx(context.Background(), tb, id, attr)
+}
+
+func (db *Db) HistoryCtx(ctx context.Context, tb string, id int, attr string) ([]Change, error) {
+	rows, err := db.historyRows(ctx, tb, id, attr)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Change, 0, len(rows))
+	for _, r := range rows {
+		c := Change{ObjId: r.ObjId, Attr: r.Attr, Actor: r.Actor}
+		c.At, _ = time.Parse(histTime, r.At)
+		if r.OldVal != nil {
+			c.Old = decodeAttr(*r.OldTyp, *r.OldVal)
+		}
+		if r.Val != nil {
+			c.New, c.Typ = decodeAttr(*r.Typ, *r.Val), *r.Typ
+		}
+		res = append(res, c)
+	}
+	return res, nil
+}
+
+// GetAsOf 傳回物件 id 在時間 at 的樣子，當時不存在則傳回 ErrNotFound
+func (db *Db) GetAsOf(tb string, id int, at time.Time) (map[string]interface{}, error) {
+	return db.GetAsOfCtx(context.Background(), tb, id, at)
+}
+
+func (db *Db) GetAsOfCtx(ctx context.Context, tb string, id int, at time.Time) (map[string]interface{}, error) {
+	rows, err := db.historyRows(ctx, tb, id, "")
+	if err != nil {
+		return nil, err
+	}
+	cur := []Table{}
+	sql := fmt.Sprintf("SELECT Id,ObjId,Attr,Val,Typ FROM %s WHERE ObjId=?;", tb)
+	if err := sqlx.SelectContext(ctx, db.x(), &cur, db.rebind(sql), id); err != nil {
+		return nil, queryError(Ident(tb), sql, err)
+	}
+
+	// 每個屬性在 at 的值: at 之前最後一筆記錄的新值，沒有則是 at 之後第一筆記錄的舊值，都沒有則是目前的值
+	type val struct{ v, typ *string }
+	vals := map[string]val{}
+	for _, r := range cur {
+		r := r
+		vals[r.Attr] = val{&r.Val, &r.Typ}
+	}
+	stamp := at.UTC().Format(histTime)
+	seen := map[string]bool{}
+	for i := len(rows) - 1; i >= 0; i-- { // 從最新的往回找
+		r := rows[i]
+		if r.At > stamp {
+			vals[r.Attr] = val{r.OldVal, r.OldTyp}
+			continue
+		}
+		if !seen[r.Attr] {
+			seen[r.Attr] = true
+			vals[r.Attr] = val{r.Val, r.Typ}
+		}
+	}
+
+	item := map[string]interface{}{}
+	for attr, v := range vals {
+		if v.v != nil {
+			item[attr] = decodeAttr(*v.typ, *v.v)
+		}
+	}
+	if len(item) == 0 {
+		return nil, fmt.Errorf("GetAsOf(%s, %d): %w", tb, id, ErrNotFound)
+	}
+	item["Id"] = id
+	return item, nil
+}
+
+// historyRows 讀出物件 id 的記錄，依時間排序
+func (db *Db) historyRows(ctx context.Context, tb string, id int, attr string) ([]histRow, error) {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return nil, err
+	}
+	hist, err := historyTb(name)
+	if err != nil {
+		return nil, err
+	}
+	rows := []histRow{}
+	sql := fmt.Sprintf("SELECT Id,ObjId,Attr,OldVal,OldTyp,Val,Typ,At,Actor FROM %s WHERE ObjId=?", hist)
+	args := []interface{}{id}
+	if attr != "" {
+		sql += " AND Attr=?"
+		args = append(args, attr)
+	}
+	sql += " ORDER BY At,Id;"
+	if err := sqlx.SelectContext(ctx, db.x(), &rows, db.rebind(sql), args...); err != nil {
+		return nil, queryError(hist, sql, err)
+	}
+	return rows, nil
+}
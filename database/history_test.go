@@ -0,0 +1,83 @@
+package database
+
+// 同一個交易寫入的 history 記錄時間都一樣，GetAsOf() 只會看到 commit 前或 commit 後的物件
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGetAsOfMultiAttrUpdate(t *testing.T) {
+	db, err := Connect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Db.SetMaxOpenConns(1) // :memory: 每個連線是不同的資料庫
+	if err := db.CreateTb("demo", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.EnableHistory("demo"); err != nil {
+		t.Fatal(err)
+	}
+	item, err := db.MapInsert("demo", map[string]interface{}{"Name": "a", "Age": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := item["Id"].(int)
+	time.Sleep(time.Millisecond)
+	if err := db.MapUpdate("demo", map[string]interface{}{"Id": id, "Name": "b", "Age": 2}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	err = db.Tx(context.Background(), func(tx *Tx) error {
+		if err := tx.MapUpdate("demo", map[string]interface{}{"Id": id, "Name": "c"}); err != nil {
+			return err
+		}
+		return tx.MapUpdate("demo", map[string]interface{}{"Id": id, "Age": 3})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := db.History("demo", id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stamps := []time.Time{}
+	for _, c := range changes {
+		if len(stamps) == 0 || !c.At.Equal(stamps[len(stamps)-1]) {
+			stamps = append(stamps, c.At)
+		}
+	}
+	if len(stamps) != 3 { // Insert, MapUpdate, Tx
+		t.Fatalf("%d distinct history times, want 3: %v", len(stamps), changes)
+	}
+
+	want := []map[string]interface{}{
+		{"Name": "a", "Age": 1, VersionAttr: 1},
+		{"Name": "b", "Age": 2, VersionAttr: 2},
+		{"Name": "c", "Age": 3, VersionAttr: 4},
+	}
+	for i, at := range stamps {
+		for _, t2 := range []time.Time{at, at.Add(-time.Nanosecond)} {
+			w := want[i]
+			if t2.Before(at) {
+				if i == 0 {
+					continue
+				}
+				w = want[i-1]
+			}
+			got, err := db.GetAsOf("demo", id, t2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range w {
+				if got[k] != v {
+					t.Errorf("GetAsOf(%v) = %v, want %v", t2, got, w)
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package database
+
+// struct 可以實作下面的介面，在寫入或讀出時做些事，例如設定時間、整理欄位、拒絕不合格的資料:
+//   func (m *Member) BeforeInsert(ctx context.Context) error { m.CreatedAt = time.Now(); return nil }
+//   func (m *Member) Validate() error {
+//       if m.Name == "" {
+//           return errors.New("Name is required")
+//       }
+//       return nil
+//   }
+// 順序: BeforeInsert/BeforeUpdate -> Validate -> 寫入 -> AfterInsert, 任何一個傳回 error 就中止並 rollback, error 原封不動傳回
+// Insert() 直接呼叫 input 的方法，input 是指標時改動會留在呼叫端
+// Update()/UpdateIfVersion() 則在 input 的複本上呼叫，改動只寫入資料庫，寫入失敗時呼叫端的值也不會被改到
+// PatchUpdate() 的 input 只有部分欄位，所以跟 MapUpdate() 一樣在併入目前值的複本上呼叫，見 patchRows()
+// Map* 系列沒有 struct, 要在 Schema.Model 指定型態(SchemaOf() 會自動設定): map 轉成 struct 呼叫後，
+// 有改動的欄位寫回 map. MapUpdate() 會先併入資料庫內目前的值，Validate 看到的是更新後的完整物件
+// AfterLoad 在 Get/Find 系列讀出物件時呼叫(同樣需要 Schema.Model), Repository.Load() 沒有 Schema.Model 時也會呼叫
+// MapAryInsert() 不呼叫
+
+import (
+	"context"
+	"errors"
+	"reflect"
+)
+
+type BeforeInserter interface {
+	BeforeInsert(ctx context.Context) error
+}
+
+// AfterInserter id 是新物件的 ObjId
+type AfterInserter interface {
+	AfterInsert(ctx context.Context, id int) error
+}
+
+type BeforeUpdater interface {
+	BeforeUpdate(ctx context.Context) error
+}
+
+type AfterLoader interface {
+	AfterLoad(ctx context.Context) error
+}
+
+// Validator Insert 與 Update 都會呼叫
+type Validator interface {
+	Validate() error
+}
+
+var (
+	beforeInserterType = reflect.TypeOf((*BeforeInserter)(nil)).Elem()
+	afterInserterType  = reflect.TypeOf((*AfterInserter)(nil)).Elem()
+	beforeUpdaterType  = reflect.TypeOf((*BeforeUpdater)(nil)).Elem()
+	afterLoaderType    = reflect.TypeOf((*AfterLoader)(nil)).Elem()
+	validatorType      = reflect.TypeOf((*Validator)(nil)).Elem()
+)
+
+// hookTarget 傳回可以呼叫 hooks 的值，input 不是指標時複製一份，這樣指標 receiver 的方法也能呼叫
+func hookTarget(input interface{}) interface{} {
+	if reflect.ValueOf(input).Kind() == reflect.Ptr {
+		return input
+	}
+	return hookCopy(input)
+}
+
+// hookCopy 傳回 input 的複本(指標), input 是指標時也複製，hooks 不會改到呼叫端的值
+func hookCopy(input interface{}) interface{} {
+	v := reflect.Indirect(reflect.ValueOf(input))
+	p := reflect.New(v.Type())
+	p.Elem().Set(v)
+	return p.Interface()
+}
+
+// beforeWrite 呼叫 BeforeInsert 或 BeforeUpdate, 再呼叫 Validate
+func beforeWrite(ctx context.Context, obj interface{}, insert bool) error {
+	if h, ok := obj.(BeforeInserter); ok && insert {
+		if err := h.BeforeInsert(ctx); err != nil {
+			return err
+		}
+	}
+	if h, ok := obj.(BeforeUpdater); ok && !insert {
+		if err := h.BeforeUpdate(ctx); err != nil {
+			return err
+		}
+	}
+	if h, ok := obj.(Validator); ok {
+		return h.Validate()
+	}
+	return nil
+}
+
+func afterInsert(ctx context.Context, obj interface{}, id int) error {
+	if h, ok := obj.(AfterInserter); ok {
+		return h.AfterInsert(ctx, id)
+	}
+	return nil
+}
+
+func afterLoad(ctx context.Context, obj interface{}) error {
+	if h, ok := obj.(AfterLoader); ok {
+		return h.AfterLoad(ctx)
+	}
+	return nil
+}
+
+// hooked 傳回 tb 的 Schema.Model, 沒有或 Model 沒有實作 kinds 任何一個介面時傳回 nil
+func (db *Db) hooked(tb Ident, kinds ...reflect.Type) reflect.Type {
+	s := db.schemaOf(tb)
+	if s == nil || s.Model == nil {
+		return nil
+	}
+	v, err := structValue(s.Model)
+	if err != nil {
+		return nil
+	}
+	for _, kind := range kinds {
+		if reflect.PtrTo(v.Type()).Implements(kind) {
+			return v.Type()
+		}
+	}
+	return nil
+}
+
+// mapHooks 把 base 併入 input 之後轉成 model 呼叫 hook, 傳回加上有改動欄位的 input 與 hook 用的 struct
+// model 為 nil 時 input 原封不動
+func mapHooks(model reflect.Type, base, input map[string]interface{}, hook func(obj interface{}) error) (map[string]interface{}, interface{}, error) {
+	if model == nil {
+		return input, nil, nil
+	}
+	merged := make(map[string]interface{}, len(base)+len(input))
+	for _, m := range []map[string]interface{}{base, input} {
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+	obj := reflect.New(model)
+	if err := decodeStruct(merged, obj.Interface()); err != nil {
+		return nil, nil, err
+	}
+	changed, err := hookRows(obj, hook)
+	if err != nil {
+		return nil, nil, err
+	}
+	res := make(map[string]interface{}, len(input))
+	for k, v := range input {
+		res[k] = v
+	}
+	for _, r := range changed {
+		res[r.Attr] = decodeAttr(r.Typ, r.Val)
+	}
+	return res, obj.Interface(), nil
+}
+
+// hookRows 對 obj (指向 struct 的指標) 呼叫 hook, 傳回 hook 改過的欄位
+func hookRows(obj reflect.Value, hook func(obj interface{}) error) ([]Table, error) {
+	pre, err := structRows(0, obj.Elem(), false)
+	if err != nil {
+		return nil, err
+	}
+	if err := hook(obj.Interface()); err != nil {
+		return nil, err
+	}
+	post, err := structRows(0, obj.Elem(), false)
+	if err != nil {
+		return nil, err
+	}
+	old := make(map[string]Table, len(pre))
+	for _, r := range pre {
+		old[r.Attr] = r
+	}
+	res := []Table{}
+	for _, r := range post {
+		if o, ok := old[r.Attr]; !ok || o.Val != r.Val || o.Typ != r.Typ {
+			res = append(res, r)
+		}
+	}
+	return res, nil
+}
+
+// patchRows PatchUpdate() 用，傳回要寫入的 rows: patch 有給值的欄位，加上 hooks 改過的欄位
+// 有 BeforeUpdate 或 Validate 時，先把 patch 有給值的欄位蓋在資料庫內目前的物件上再呼叫，
+// 跟 MapUpdate() 一樣 Validate 看到的是更新後的完整物件, 改動只寫入資料庫，不會改到 input
+func (db *Db) patchRows(ctx context.Context, tb Ident, objId int, input reflect.Value) ([]Table, error) {
+	rows, err := structRows(objId, input, true)
+	if err != nil {
+		return nil, err
+	}
+	ptr := reflect.PtrTo(input.Type())
+	if !ptr.Implements(beforeUpdaterType) && !ptr.Implements(validatorType) {
+		return rows, nil
+	}
+	base, err := db.FindCtx(ctx, string(tb), objId)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	obj := reflect.New(input.Type())
+	if err := decodeStruct(base, obj.Interface()); err != nil {
+		return nil, err
+	}
+	for i := 0; i < input.NumField(); i++ {
+		if input.Type().Field(i).PkgPath == "" && !input.Field(i).IsZero() {
+			obj.Elem().Field(i).Set(input.Field(i))
+		}
+	}
+	changed, err := hookRows(obj, func(obj interface{}) error {
+		return beforeWrite(ctx, obj, false)
+	})
+	if err != nil {
+		return nil, err
+	}
+	idx := make(map[string]int, len(rows))
+	for i, r := range rows {
+		idx[r.Attr] = i
+	}
+	for _, r := range changed {
+		r.ObjId = objId
+		if i, ok := idx[r.Attr]; ok {
+			rows[i] = r
+		} else {
+			rows = append(rows, r)
+		}
+	}
+	return rows, nil
+}
+
+// mapBeforeUpdate MapUpdate() 用的 mapHooks(), 呼叫 BeforeUpdate 與 Validate
+func (db *Db) mapBeforeUpdate(ctx context.Context, tb Ident, objId int, input map[string]interface{}, unset []string) (map[string]interface{}, error) {
+	model := db.hooked(tb, beforeUpdaterType, validatorType)
+	if model == nil {
+		return input, nil
+	}
+	base, err := db.FindCtx(ctx, string(tb), objId)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	for _, attr := range unset {
+		delete(base, attr)
+	}
+	input, _, err = mapHooks(model, base, input, func(obj interface{}) error {
+		return beforeWrite(ctx, obj, false)
+	})
+	return input, err
+}
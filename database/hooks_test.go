@@ -0,0 +1,134 @@
+package database
+
+// hooks 的呼叫時機: AfterLoad 不會看到已刪除的物件
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type hookMember struct {
+	Id   int
+	Name string
+}
+
+var afterLoads = 0
+
+func (m *hookMember) AfterLoad(ctx context.Context) error {
+	afterLoads++
+	if m.Name == "bad" {
+		return errors.New("bad object")
+	}
+	return nil
+}
+
+func hookDb(t *testing.T) *Db {
+	db, err := Connect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Db.SetMaxOpenConns(1) // :memory: 每個連線是不同的資料庫
+	if err := db.CreateTb("demo", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetSchema("demo", &Schema{Model: hookMember{}}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestAfterLoadSkipsDeleted(t *testing.T) {
+	db := hookDb(t)
+	if err := db.EnableSoftDelete("demo"); err != nil {
+		t.Fatal(err)
+	}
+	bad, err := db.Insert("demo", hookMember{Name: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Insert("demo", hookMember{Name: "good"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Del("demo", bad["Id"].(int)); err != nil {
+		t.Fatal(err)
+	}
+	// 已刪除的物件讀出來會讓 AfterLoad 傳回 error
+	if _, err := db.Db.Exec("UPDATE demo SET Val='bad' WHERE ObjId=? AND Attr='Name';", bad["Id"]); err != nil {
+		t.Fatal(err)
+	}
+
+	afterLoads = 0
+	items, err := db.FindAll("demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0]["Name"] != "good" || afterLoads != 1 {
+		t.Errorf("FindAll = %v with %d AfterLoad calls, want only good with 1 call", items, afterLoads)
+	}
+	if _, err := db.IncludeDeleted().FindAll("demo"); err == nil {
+		t.Errorf("IncludeDeleted().FindAll: AfterLoad error not returned")
+	}
+}
+
+// Update()/UpdateIfVersion() 在複本上呼叫 BeforeUpdate/Validate, 寫入成功或失敗都不會改到呼叫端的值
+type stampMember struct {
+	Id    int
+	Name  string
+	Age   int
+	Edits int
+}
+
+func (m *stampMember) BeforeUpdate(ctx context.Context) error {
+	m.Edits++
+	return nil
+}
+
+func (m *stampMember) Validate() error {
+	if m.Age < 0 {
+		return errors.New("negative Age")
+	}
+	return nil
+}
+
+func TestUpdateHooksOnCopy(t *testing.T) {
+	db, err := Connect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Db.SetMaxOpenConns(1) // :memory: 每個連線是不同的資料庫
+	if err := db.CreateTb("demo", false); err != nil {
+		t.Fatal(err)
+	}
+	item, err := db.Insert("demo", stampMember{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := item["Id"].(int)
+
+	m := &stampMember{Id: id, Name: "b"}
+	if err := db.Update("demo", m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Edits != 0 {
+		t.Errorf("Update changed input: %+v", m)
+	}
+	if item, _ := db.Find("demo", id); item["Edits"] != 1 {
+		t.Errorf("after Update Edits = %v, want 1", item["Edits"])
+	}
+
+	bad := &stampMember{Id: id, Name: "c", Age: -1}
+	if err := db.Update("demo", bad); err == nil {
+		t.Fatal("Update with negative Age succeeded")
+	}
+	stale := &stampMember{Id: id, Name: "d"}
+	if err := db.UpdateIfVersion("demo", stale, 1); !errors.Is(err, ErrConflict) {
+		t.Fatalf("UpdateIfVersion with stale version: %v, want ErrConflict", err)
+	}
+	if bad.Edits != 0 || stale.Edits != 0 {
+		t.Errorf("failed updates changed input: %+v, %+v", bad, stale)
+	}
+	if item, _ := db.Find("demo", id); item["Name"] != "b" || item["Edits"] != 1 {
+		t.Errorf("after failed updates got %v, want Name b, Edits 1", item)
+	}
+}
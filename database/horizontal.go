@@ -0,0 +1,419 @@
+package database
+
+// 已經有一般(橫式) 表格的話，可以轉成直式表格，或反過來:
+//   report, err := db.ImportHorizontal("members", "member", "id")  // members 的每一列變成一個物件，id 欄位當 ObjId
+//   report, err := db.ExportHorizontal("member", "members_bak")     // 每個物件一列，每個屬性一欄
+// 每次處理一批(預設 500 筆), 每一批在一個交易內寫入，某一批失敗時，之前的批次已經寫入，
+// 已處理的筆數與無法轉換的資料記錄在 HorizontalReport
+// 匯入的物件跟 Update 一樣 Version 加 1, 來源的 Version 欄位不寫入
+// 匯入時依 idColumn 或來源表格的主鍵分批讀取(都沒有則依所有欄位), 批次之間才不會漏掉或重複
+// 匯入時 Typ 依欄位型態決定，例如 INTEGER 存成 "int", 值無法轉換的那一筆略過; NULL 的欄位不存
+// 匯出時欄位型態依屬性的 Typ 決定(規則同 CreatePivotView()), 屬性名稱不能當欄位名稱的略過
+
+import (
+	"context"
+	dbsql "database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	t "dbx/time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// HorizontalOption 調整 ImportHorizontal()/ExportHorizontal() 的行為
+type HorizontalOption func(o *horizontalOpts)
+
+type horizontalOpts struct {
+	batch int
+}
+
+// BatchSize 每一批處理幾筆，預設 500
+func BatchSize(n int) HorizontalOption {
+	return func(o *horizontalOpts) {
+		if n > 0 {
+			o.batch = n
+		}
+	}
+}
+
+type HorizontalReport struct {
+	Rows    int // 讀到幾筆
+	Written int // 寫入幾筆
+	Errors  []ConvertError
+}
+
+// ConvertError 某一筆的某個欄位(屬性) 無法轉換
+type ConvertError struct {
+	Row    int    // 第幾筆，從 1 開始
+	Column string // 欄位或屬性名稱
+	Err    error
+}
+
+func (e ConvertError) Error() string {
+	return fmt.Sprintf("row %d, %s: %s", e.Row, e.Column, e.Err.Error())
+}
+
+// ImportHorizontal 把一般表格 src 的每一列轉成直式表格 dst 的一個物件, dst 必須已經用 CreateTb() 建立
+// idColumn 的值當成 ObjId, 已存在的物件會被更新; idColumn = "" 則配置新的 ObjId
+func (db *Db) ImportHorizontal(src, dst, idColumn string, opts ...HorizontalOption) (HorizontalReport, error) {
+	return db.ImportHorizontalCtx(context.Background(), src, dst, idColumn, opts...)
+}
+
+func (db *Db) ImportHorizontalCtx(ctx context.Context, src, dst, idColumn string, opts ...HorizontalOption) (HorizontalReport, error) {
+	report := HorizontalReport{Errors: []ConvertError{}}
+	srcName, err := ParseIdent(src)
+	if err != nil {
+		return report, err
+	}
+	name, err := ParseIdent(dst)
+	if err != nil {
+		return report, err
+	}
+	if idColumn != "" {
+		if _, err := ParseIdent(idColumn); err != nil {
+			return report, err
+		}
+	}
+	order, err := db.importOrder(ctx, srcName, idColumn)
+	if err != nil {
+		return report, err
+	}
+	o := horizontalOpts{batch: 500}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// 先讀完一批再寫入，sqlite3 讀取中的連線會擋住別的連線寫入
+	for offset := 0; ; offset += o.batch {
+		sql := fmt.Sprintf("SELECT * FROM %s ORDER BY %s LIMIT ? OFFSET ?;", srcName, order)
+		rows, err := db.x().QueryxContext(ctx, db.rebind(sql), o.batch, offset)
+		if err != nil {
+			return report, queryError(srcName, sql, err)
+		}
+		cols, err := rows.ColumnTypes()
+		if err != nil {
+			rows.Close()
+			return report, queryError(srcName, sql, err)
+		}
+		batch := [][]interface{}{}
+		for rows.Next() {
+			vals, err := rows.SliceScan()
+			if err != nil {
+				rows.Close()
+				return report, queryError(srcName, sql, err)
+			}
+			batch = append(batch, vals)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return report, queryError(srcName, sql, err)
+		}
+
+		written := 0
+		err = db.atomic(ctx, func(db *Db) error {
+			ids := []int{}
+			for i, vals := range batch {
+				row := offset + i + 1
+				objs, errs := importRow(row, cols, vals, idColumn)
+				if len(errs) > 0 {
+					report.Errors = append(report.Errors, errs...)
+					continue
+				}
+				objId := 0
+				if idColumn == "" {
+					if objId, err = db.allocId(ctx, name); err != nil {
+						return err
+					}
+				} else if objId, errs = importId(row, idColumn, cols, vals); len(errs) > 0 {
+					report.Errors = append(report.Errors, errs...)
+					continue
+				}
+				for j := range objs {
+					objs[j].ObjId = objId
+				}
+				if objs, err = db.checkSchema(ctx, name, objId, objs, nil, idColumn == ""); err != nil {
+					report.Errors = append(report.Errors, ConvertError{Row: row, Column: "", Err: err})
+					continue
+				}
+				if err := db.upsertRows(ctx, name, dropVersion(objs)); err != nil {
+					return err
+				}
+				ids = append(ids, objId)
+				written++
+			}
+			return db.bumpVersions(ctx, name, ids) // 新的物件 Version 為 1
+		})
+		if err != nil {
+			return report, err
+		}
+		report.Rows += len(batch)
+		report.Written += written
+		if len(batch) < o.batch {
+			return report, nil
+		}
+	}
+}
+
+// importOrder 分批讀取 src 的順序，順序不固定時批次之間會漏掉或重複:
+// idColumn, 沒有則用主鍵，也沒有主鍵則依所有欄位(內容完全相同的列誰先誰後都一樣)
+// 用欄位的位置排序，不必處理欄位名稱的引號
+func (db *Db) importOrder(ctx context.Context, src Ident, idColumn string) (string, error) {
+	sql := fmt.Sprintf("SELECT * FROM %s LIMIT 0;", src)
+	rows, err := db.x().QueryxContext(ctx, sql)
+	if err != nil {
+		return "", queryError(src, sql, err)
+	}
+	cols, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return "", queryError(src, sql, err)
+	}
+
+	keys := []string{}
+	if idColumn != "" {
+		keys = append(keys, idColumn)
+	} else {
+		sql = db.Dialect().PrimaryKey(src)
+		if err := sqlx.SelectContext(ctx, db.x(), &keys, db.rebind(sql), string(src)); err != nil {
+			return "", queryError(src, sql, err)
+		}
+	}
+	pos := []string{}
+	for _, key := range keys {
+		for i, col := range cols {
+			if strings.EqualFold(col, key) {
+				pos = append(pos, strconv.Itoa(i+1))
+				break
+			}
+		}
+	}
+	if len(pos) == 0 || len(pos) != len(keys) {
+		pos = pos[:0]
+		for i := range cols {
+			pos = append(pos, strconv.Itoa(i+1))
+		}
+	}
+	return strings.Join(pos, ","), nil
+}
+
+// importRow 把一列轉成屬性, ObjId 之後再填
+func importRow(row int, cols []*dbsql.ColumnType, vals []interface{}, idColumn string) ([]Table, []ConvertError) {
+	objs := []Table{}
+	errs := []ConvertError{}
+	for i, col := range cols {
+		if col.Name() == idColumn || col.Name() == "Id" || vals[i] == nil { // Id 就是 ObjId, 不另外存
+			continue
+		}
+		v, err := convertCol(vals[i], typOfColumn(col.DatabaseTypeName()))
+		if err == nil {
+			var val, typ string
+			if val, typ, err = encodeAttr(v); err == nil {
+				objs = append(objs, Table{Attr: col.Name(), Val: val, Typ: typ})
+				continue
+			}
+		}
+		errs = append(errs, ConvertError{Row: row, Column: col.Name(), Err: err})
+	}
+	return objs, errs
+}
+
+// importId 取出 idColumn 的值當 ObjId
+func importId(row int, idColumn string, cols []*dbsql.ColumnType, vals []interface{}) (int, []ConvertError) {
+	for i, col := range cols {
+		if col.Name() != idColumn {
+			continue
+		}
+		v, err := convertCol(vals[i], "int")
+		if err == nil && v.(int) <= 0 {
+			err = fmt.Errorf("ObjId must be positive, got %d", v)
+		}
+		if err != nil {
+			return 0, []ConvertError{{Row: row, Column: idColumn, Err: err}}
+		}
+		return v.(int), nil
+	}
+	return 0, []ConvertError{{Row: row, Column: idColumn, Err: fmt.Errorf("no such column")}}
+}
+
+// typOfColumn 依欄位型態決定 Typ
+func typOfColumn(dbType string) string {
+	typ := strings.ToUpper(dbType)
+	switch {
+	case strings.Contains(typ, "INTERVAL") || strings.Contains(typ, "POINT"):
+		return "string"
+	case strings.Contains(typ, "INT"):
+		return "int"
+	case strings.Contains(typ, "BOOL"):
+		return "bool"
+	case strings.Contains(typ, "REAL") || strings.Contains(typ, "FLOA") || strings.Contains(typ, "DOUB") ||
+		strings.Contains(typ, "DEC") || strings.Contains(typ, "NUMERIC"):
+		return "float64"
+	case strings.Contains(typ, "DATE") || strings.Contains(typ, "TIMESTAMP"):
+		return "time.Time"
+	case strings.Contains(typ, "BLOB") || strings.Contains(typ, "BYTEA") || strings.Contains(typ, "BINARY"):
+		return "[]byte"
+	}
+	return "string"
+}
+
+// convertCol 把 driver 讀出來的值轉成 typ 對應的型態
+// driver 傳回的不外乎 int64, float64, bool, []byte, string, time.Time
+func convertCol(v interface{}, typ string) (interface{}, error) {
+	if b, ok := v.([]byte); ok && typ != "[]byte" {
+		v = string(b)
+	}
+	switch typ {
+	case "int":
+		switch tv := v.(type) {
+		case int64:
+			return int(tv), nil
+		case float64:
+			if tv == float64(int(tv)) {
+				return int(tv), nil
+			}
+		case string:
+			return strconv.Atoi(strings.TrimSpace(tv))
+		}
+	case "float64":
+		switch tv := v.(type) {
+		case int64:
+			return float64(tv), nil
+		case float64:
+			return tv, nil
+		case string:
+			return strconv.ParseFloat(strings.TrimSpace(tv), 64)
+		}
+	case "bool":
+		switch tv := v.(type) {
+		case bool:
+			return tv, nil
+		case int64:
+			return tv != 0, nil
+		case string:
+			return strconv.ParseBool(tv)
+		}
+	case "time.Time":
+		switch tv := v.(type) {
+		case time.Time:
+			return tv, nil
+		case string:
+			for _, layout := range []string{"2006-01-02 15:04:05.999999999", "2006-01-02"} {
+				if tt, err := time.Parse(layout, tv); err == nil {
+					return tt, nil
+				}
+			}
+			return parseTime(tv)
+		}
+	case "[]byte":
+		switch tv := v.(type) {
+		case []byte:
+			return append([]byte{}, tv...), nil
+		case string:
+			return []byte(tv), nil
+		}
+	default:
+		switch tv := v.(type) {
+		case string:
+			return tv, nil
+		case time.Time:
+			return formatTime(tv), nil
+		}
+		return fmt.Sprint(v), nil
+	}
+	return nil, fmt.Errorf("cannot convert %T %v to %s", v, v, typ)
+}
+
+// ExportHorizontal 把直式表格 tb 轉成一般表格 dst, 每個物件一列，Id 欄位是 ObjId, dst 不能已經存在
+func (db *Db) ExportHorizontal(tb, dst string, opts ...HorizontalOption) (HorizontalReport, error) {
+	return db.ExportHorizontalCtx(context.Background(), tb, dst, opts...)
+}
+
+func (db *Db) ExportHorizontalCtx(ctx context.Context, tb, dst string, opts ...HorizontalOption) (HorizontalReport, error) {
+	report := HorizontalReport{Errors: []ConvertError{}}
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return report, err
+	}
+	dstName, err := ParseIdent(dst)
+	if err != nil {
+		return report, err
+	}
+	o := horizontalOpts{batch: 500}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	attrs := []string{}
+	sql := fmt.Sprintf("SELECT DISTINCT Attr FROM %s WHERE Attr<>'Id' ORDER BY Attr;", name)
+	if err := sqlx.SelectContext(ctx, db.x(), &attrs, sql); err != nil {
+		return report, queryError(name, sql, err)
+	}
+	typs, err := db.pivotTyps(ctx, name, attrs)
+	if err != nil {
+		return report, err
+	}
+	d := db.Dialect()
+	cols := []string{}
+	defs := []string{"Id INTEGER PRIMARY KEY"}
+	for _, attr := range attrs {
+		if _, err := ParseIdent(attr); err != nil || strings.EqualFold(attr, "Id") {
+			report.Errors = append(report.Errors, ConvertError{Column: attr, Err: fmt.Errorf("cannot be a column name")})
+			continue
+		}
+		cols = append(cols, attr)
+		defs = append(defs, attr+" "+d.ColumnType(typs[attr]))
+	}
+	sql = fmt.Sprintf("CREATE TABLE %s ( %s );", dstName, strings.Join(defs, ", "))
+	if _, err := db.x().ExecContext(ctx, sql); err != nil {
+		return report, queryError(dstName, sql, err)
+	}
+
+	after := 0
+	for {
+		page, err := db.FindPageCtx(ctx, tb, PageOpts{Limit: o.batch, After: after})
+		if err != nil {
+			return report, err
+		}
+		err = db.atomic(ctx, func(db *Db) error {
+			sql := fmt.Sprintf("INSERT INTO %s (%s) VALUES (?%s);", dstName,
+				strings.Join(append([]string{"Id"}, cols...), ","), strings.Repeat(",?", len(cols)))
+			for _, item := range page.Items {
+				args := []interface{}{item["Id"]}
+				for _, col := range cols {
+					args = append(args, exportVal(item[col], d.ColumnType(typs[col])))
+				}
+				if _, err := db.x().ExecContext(ctx, db.rebind(sql), args...); err != nil {
+					return queryError(dstName, sql, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+		report.Rows += len(page.Items)
+		report.Written += len(page.Items)
+		if !page.More {
+			return report, nil
+		}
+		after = page.Next
+	}
+}
+
+// exportVal 文字欄位存跟 Val 相同的字串，其他欄位交給 driver
+func exportVal(v interface{}, colType string) interface{} {
+	switch tv := v.(type) {
+	case nil:
+		return nil
+	case t.Time:
+		return time.Time(tv)
+	}
+	if strings.Contains(colType, "TEXT") {
+		return encodeVal(v)
+	}
+	return v
+}
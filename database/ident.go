@@ -0,0 +1,37 @@
+package database
+
+// 表格名稱沒辦法像 Attr/Val 一樣用 placeholder 綁定，只能組進 SQL 字串裡，
+// 所以傳進來的 tb 一律先經過 ParseIdent() 檢查，不合格的直接拒絕，
+// 這樣就不會有人透過表格名稱做 SQL injection
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Ident 是檢查過的 SQL 識別字(表格名稱), 只能由 ParseIdent()/MustIdent() 產生
+type Ident string
+
+// 英文字母或底線開頭，後面接英數字或底線，長度不超過 64 (MySQL 的限制)
+var identRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,63}$`)
+
+// ParseIdent 檢查 s 是否為合法的表格名稱
+func ParseIdent(s string) (Ident, error) {
+	if !identRe.MatchString(s) {
+		return "", fmt.Errorf("invalid identifier %q", s)
+	}
+	return Ident(s), nil
+}
+
+// MustIdent 同 ParseIdent(), 但不合法時直接 panic, 適合用在常數表格名稱
+func MustIdent(s string) Ident {
+	id, err := ParseIdent(s)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func (id Ident) String() string {
+	return string(id)
+}
@@ -0,0 +1,80 @@
+package database
+
+// CreateIndex() 建立的索引在 sqlite3 真的會用到, 用 EXPLAIN QUERY PLAN 檢查
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queryPlan 傳回 filter 查詢的 EXPLAIN QUERY PLAN
+func queryPlan(t *testing.T, db *Db, tb string, filter Filter) string {
+	where, args := filter.where(db.Dialect(), Ident(tb))
+	sql := fmt.Sprintf("EXPLAIN QUERY PLAN SELECT ObjId,Attr,Val,Typ FROM %s WHERE %s ORDER BY ObjId,Id;", tb, where)
+	rows, err := db.Db.Queryx(db.Db.Rebind(sql), args...)
+	if err != nil {
+		t.Fatalf("%s: %s", sql, err.Error())
+	}
+	defer rows.Close()
+	plan := []string{}
+	for rows.Next() {
+		cols, err := rows.SliceScan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan = append(plan, fmt.Sprint(cols[len(cols)-1]))
+	}
+	return strings.Join(plan, "\n")
+}
+
+func TestCreateIndexUsed(t *testing.T) {
+	db, err := Connect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Db.SetMaxOpenConns(1) // :memory: 每個連線是不同的資料庫
+	if err := db.CreateTb("m", false); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		item := map[string]interface{}{"Name": fmt.Sprint("n", i), "Age": i, "At": start.AddDate(0, 0, i)}
+		if _, err := db.MapInsert("m", item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, attr := range []string{"Age", "At"} {
+		if err := db.CreateIndex("m", attr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		filter Filter
+		index  string
+	}{
+		{Attr("Age").Eq(3), "ix_m_Age "},
+		{Attr("Age").Gt(3), "ix_m_Age_n"},
+		{Attr("Age").Between(3, 5), "ix_m_Age_n"},
+		{Attr("At").Gt(start.AddDate(0, 0, 10)), "ix_m_At_t"},
+	}
+	for _, c := range cases {
+		plan := queryPlan(t, db, "m", c.filter)
+		if !strings.Contains(plan+" ", c.index) {
+			t.Errorf("%s not used:\n%s", strings.TrimSpace(c.index), plan)
+		}
+	}
+
+	// 沒有索引的屬性不會用到
+	if plan := queryPlan(t, db, "m", Attr("Name").Eq("n3")); strings.Contains(plan, "ix_m_") {
+		t.Errorf("unexpected index for Name:\n%s", plan)
+	}
+	if err := db.DropIndex("m", "Age"); err != nil {
+		t.Fatal(err)
+	}
+	if plan := queryPlan(t, db, "m", Attr("Age").Eq(3)); strings.Contains(plan, "ix_m_Age") {
+		t.Errorf("index still used after DropIndex:\n%s", plan)
+	}
+}
@@ -3,115 +3,181 @@ package database
 // 這邊負責將 map[string]interface{} 存到資料表，主要是給 json 使用
 
 import (
+	"context"
 	"fmt"
-	"reflect"
-	"strings"
 )
 
 func (db *Db) MapInsert(tb string, input map[string]interface{}) (map[string]interface{}, error) {
-	objId := db.NextId(tb)
-
-	// 要知道的是，input 每個Key:Value，對表格來說都是一筆資料
-	sql := "INSERT INTO " + tb + " (ObjId,Attr,Val,Typ) VALUES "
-	// 透過 reflect.TypeOf().Field(i) 可以 traverse 每個欄位
-    for k, v := range input {
-		typ := fmt.Sprintf("%v", reflect.TypeOf(v))
-		if typ == "float64" || typ == "int64" || typ == "json.Number" {
-			sql = fmt.Sprintf(`%s (%d,"%s","%v","%s"),`, sql,
-				objId, k, v, "int")
-		} else {
-			sql = fmt.Sprintf(`%s (%d,"%s","%v","%s"),`, sql,
-				objId, k, v, typ)
+	return db.MapInsertCtx(context.Background(), tb, input)
+}
+
+func (db *Db) MapInsertCtx(ctx context.Context, tb string, input map[string]interface{}) (map[string]interface{}, error) {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return nil, err
+	}
+	// 見 hooks.go
+	model := db.hooked(name, beforeInserterType, validatorType, afterInserterType)
+	input, obj, err := mapHooks(model, nil, input, func(obj interface{}) error {
+		return beforeWrite(ctx, obj, true)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]interface{}
+	err = db.atomic(ctx, func(db *Db) error {
+		objId, err := db.allocId(ctx, name)
+		if err != nil {
+			return err
 		}
-    }
-	sql = strings.TrimRight(sql, ",")
-	sql = sql + ";"
-	db.Db.Exec(sql)
-	data := db.Get(tb, objId)
+
+		// 要知道的是，input 每個Key:Value，對表格來說都是一筆資料
+		rows, err := mapRows(objId, input)
+		if err != nil {
+			return err
+		}
+		if rows, err = db.checkSchema(ctx, name, objId, rows, nil, true); err != nil {
+			return err
+		}
+		if err := db.insertRows(ctx, name, withVersion(rows, objId, 1)); err != nil {
+			return err
+		}
+		if err := afterInsert(ctx, obj, objId); err != nil {
+			return err
+		}
+		data, err = db.FindCtx(ctx, tb, objId)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 	return data, nil
 }
 
 // 給 termcap 專用，用有效率的方式一次性插入一堆 []map[string]string
 func (db *Db) MapAryInsert(tb string, data []map[string]string, check bool) error {
-	objId := db.MaxId(tb)
-
-	tx := db.Db.MustBegin()
+	return db.MapAryInsertCtx(context.Background(), tb, data, check)
+}
 
-	sql := ""
-	for _,input := range data {
-		objId = objId + 1
-		// 要知道的是，input 每個Key:Value，對表格來說都是一筆資料
-		sql = "INSERT INTO " + tb + " (ObjId,Attr,Val,Typ) VALUES "
-		// 透過 reflect.TypeOf().Field(i) 可以 traverse 每個欄位
-	    for k, v := range input {
-			typ := fmt.Sprintf("%v", reflect.TypeOf(v))
-			if typ == "float64" || typ == "int64" || typ == "json.Number" {
-				sql = fmt.Sprintf(`%s (%d,"%s","%v","%s"),`, sql,
-					objId, k, v, "int")
-			} else {
-				sql = fmt.Sprintf(`%s (%d,"%s","%v","%s"),`, sql,
-					objId, k, v, typ)
+func (db *Db) MapAryInsertCtx(ctx context.Context, tb string, data []map[string]string, check bool) error {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return err
+	}
+	return db.atomic(ctx, func(db *Db) error {
+		for _,input := range data {
+			objId, err := db.allocId(ctx, name)
+			if err != nil {
+				return err
 			}
-	    }
-		sql = strings.TrimRight(sql, ",")
-		sql = sql + ";"
-		db.Db.MustExec(sql)
+			// 要知道的是，input 每個Key:Value，對表格來說都是一筆資料
+			rows := make([]Table, 0, len(input))
+			for k, v := range input {
+				rows = append(rows, Table{ObjId: objId, Attr: k, Val: v, Typ: "string"})
+			}
+			if rows, err = db.checkSchema(ctx, name, objId, rows, nil, true); err != nil {
+				return err
+			}
+			if err := db.insertRows(ctx, name, withVersion(rows, objId, 1)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateOption 調整 MapUpdate() 的行為
+type UpdateOption func(o *updateOpts)
+
+type updateOpts struct {
+	nilDeletes bool
+}
+
+// NilDeletes 讓 MapUpdate() 把值為 nil 的 key 當成刪除該屬性，
+// 沒有指定時 nil 會跟以前一樣存成 Typ 為 "nil" 的屬性
+func NilDeletes() UpdateOption {
+	return func(o *updateOpts) {
+		o.nilDeletes = true
 	}
-	tx.Commit()
-	return nil
 }
 
-func (db *Db) MapUpdate(tb string, input map[string]interface{}) error {
-	objId := db.MapGetId(input)
+func (db *Db) MapUpdate(tb string, input map[string]interface{}, opts ...UpdateOption) error {
+	return db.MapUpdateCtx(context.Background(), tb, input, opts...)
+}
+
+func (db *Db) MapUpdateCtx(ctx context.Context, tb string, input map[string]interface{}, opts ...UpdateOption) error {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return err
+	}
+	objId, err := mapId(input)
+	if err != nil {
+		return err
+	}
 	if objId <= 0 {
 		return fmt.Errorf("Cannot Update table without Id field")
 	}
+	o := updateOpts{}
+	for _, opt := range opts {
+		opt(&o)
+	}
 
-	// 透過 reflect.TypeOf().Field(i) 可以 traverse 每個欄位
-	sql := ""
-	// 一直找不到適合的 IF EXIST UPDATE ELSE INSERT 語句，只好分兩段，先查，再判斷
-    for k, v := range input {
-		val := ""
-		sql = fmt.Sprintf(`SELECT Val FROM %s WHERE objId=%d AND Attr="%s";`, tb, objId, k)
-		err := db.Db.Get(&val, sql)
-		exists := true
-		if err != nil {
-			exists = false
-		}
-		typ := fmt.Sprintf("%v", reflect.TypeOf(v))
-		if typ == "json.Number" {	// json 的數字在轉換時很怪, 需要特別處理
-			typ = "int"
-		}
-		if !exists { // 不存在
-			sql = fmt.Sprintf(`INSERT INTO %s (ObjId,Attr,Val,Typ) VALUES
-				(%d,"%s","%v","%v");`, tb, objId, k, v, typ)
-		} else {
-			sql = fmt.Sprintf(`UPDATE %s Set Val="%v" WHERE objId=%d AND Attr="%s";`,
-				tb, v, objId, k)
+	unset := []string{}
+	if o.nilDeletes {
+		rest := make(map[string]interface{}, len(input))
+		for k, v := range input {
+			if v == nil {
+				unset = append(unset, k)
+			} else {
+				rest[k] = v
+			}
 		}
-		_,err = db.Db.Exec(sql)
-    }
-	return nil
+		input = rest
+	}
+	if input, err = db.mapBeforeUpdate(ctx, name, objId, input, unset); err != nil {
+		return err
+	}
+	rows, err := mapRows(objId, input)
+	if err != nil {
+		return err
+	}
+	return db.updateRows(ctx, name, objId, rows, unset, anyVersion)
 }
 
 // 如果給的資料 Id == 0 || 不存在，則 Insert
-// 如果 Id > 0 && 存在 則 Update
+// 如果 Id > 0 && 存在 則 Update, input 帶有 Version 時必須跟資料庫內的相同，見 UpdateIfVersion()
 // PS: 存不存在由 Id 決定
 func (db *Db) MapInsOrEdit(tb string, input map[string]interface{}) map[string]interface{} {
-	if id := db.MapGetId(input); id > 0 { // id > 0 才有機會是 Update, 否則一律 Insert
-		if item := db.Get(tb, id); len(item) == 0 { // Not existed
-			item, err := db.MapInsert(tb, input)
+	return db.MapInsOrEditCtx(context.Background(), tb, input)
+}
+
+func (db *Db) MapInsOrEditCtx(ctx context.Context, tb string, input map[string]interface{}) map[string]interface{} {
+	id, err := mapId(input)
+	if err != nil {
+		db.logf("database.MapInsOrEdit() %s\n", err.Error())
+		return map[string]interface{}{}
+	}
+	if id > 0 { // id > 0 才有機會是 Update, 否則一律 Insert
+		if item := db.GetCtx(ctx, tb, id); len(item) == 0 { // Not existed
+			item, err := db.MapInsertCtx(ctx, tb, input)
 			if err == nil {
 				return item
 			} else {
 				return map[string]interface{}{}
 			}
 		} else {
-			db.MapUpdate(tb, input)
-			return db.Get(tb, id)
+			if version, ok := versionOf(input); ok { // 有帶 Version 就檢查
+				if err := db.UpdateIfVersionCtx(ctx, tb, input, version); err != nil {
+					db.logf("database.MapInsOrEdit() %s\n", err.Error())
+					return map[string]interface{}{}
+				}
+			} else {
+				db.MapUpdateCtx(ctx, tb, input)
+			}
+			return db.GetCtx(ctx, tb, id)
 		}
 	} else {
-		item, err := db.MapInsert(tb, input)
+		item, err := db.MapInsertCtx(ctx, tb, input)
 		if err == nil {
 			return item
 		} else {
@@ -123,9 +189,18 @@ func (db *Db) MapInsOrEdit(tb string, input map[string]interface{}) map[string]i
 // 如果 Id > 0 && 不存在才 Insert, 否則 Skip
 // PS: 存不存在由 Id 決定
 func (db *Db) MapInsIfNotExist(tb string, input map[string]interface{}) map[string]interface{} {
-	if id := db.MapGetId(input); id > 0 { // id > 0 才有機會找出資料項
-		if item := db.Get(tb, id); len(item) == 0 { // Not existed
-			item, err := db.MapInsert(tb, input)
+	return db.MapInsIfNotExistCtx(context.Background(), tb, input)
+}
+
+func (db *Db) MapInsIfNotExistCtx(ctx context.Context, tb string, input map[string]interface{}) map[string]interface{} {
+	id, err := mapId(input)
+	if err != nil {
+		db.logf("database.MapInsIfNotExist() %s\n", err.Error())
+		return map[string]interface{}{}
+	}
+	if id > 0 { // id > 0 才有機會找出資料項
+		if item := db.GetCtx(ctx, tb, id); len(item) == 0 { // Not existed
+			item, err := db.MapInsertCtx(ctx, tb, input)
 			if err == nil {
 				return item
 			} else {
@@ -136,10 +211,40 @@ func (db *Db) MapInsIfNotExist(tb string, input map[string]interface{}) map[stri
 	return map[string]interface{}{}
 }
 
-// 一般 Id 都不會是 <= 0
+// 一般 Id 都不會是 <= 0, 沒有 Id 或 Id 不是數字時傳回 -1, 需要分辨請用 mapId()
 func (db *Db) MapGetId(input map[string]interface{}) int {
-	if _,ok := input["Id"]; ok {
-		return input["Id"].(int) // int(input["Id"].(float64))
+	id, err := mapId(input)
+	if err != nil {
+		return -1
+	}
+	return id
+}
+
+// mapId 取出 input 的 Id, json 解出來的 float64/json.Number 也可以(見 intOf()), 沒有 Id 時為 -1
+func mapId(input map[string]interface{}) (int, error) {
+	v, ok := input["Id"]
+	if !ok {
+		return -1, nil
+	}
+	id, ok := intOf(v)
+	if !ok {
+		return -1, fmt.Errorf("Id must be a number, got %T %v", v, v)
+	}
+	return id, nil
+}
+
+// mapRows 將 input 每個 Key:Value 轉成一筆 Table 資料
+func mapRows(objId int, input map[string]interface{}) ([]Table, error) {
+	rows := make([]Table, 0, len(input))
+	for k, v := range input {
+		if k == "Id" { // Id 就是 ObjId, 不另外存
+			continue
+		}
+		val, typ, err := encodeAttr(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", k, err.Error())
+		}
+		rows = append(rows, Table{ObjId: objId, Attr: k, Val: val, Typ: typ})
 	}
-	return -1
+	return rows, nil
 }
@@ -0,0 +1,220 @@
+package migrate
+
+// 依序執行有名稱的 migration, 已執行過的記錄在 schema_migrations 表格
+// 用法:
+//   m, err := migrate.New(db,
+//       migrate.Migration{Name: "0001_member", Up: migrate.CreateTb("member"), Down: migrate.DropTb("member")},
+//       migrate.Migration{Name: "0002_nick_to_name",
+//           Up:   migrate.Steps(migrate.RenameAttr("member", "Nick", "Name"), migrate.DefaultAttr("member", "Level", 1)),
+//           Down: migrate.Steps(migrate.DropAttr("member", "Level"), migrate.RenameAttr("member", "Name", "Nick"))},
+//   )
+//   applied, err := m.Up(ctx)       // 執行還沒執行過的，依 Name 排序
+//   reverted, err := m.Down(ctx, 1) // 還原最後一個
+// 每個 migration 在自己的交易內執行並記錄，失敗時停在該 migration, 之前的保持已執行
+// MySQL 的 CREATE/DROP TABLE 會自動 commit, 所以 CreateTb()/DropTb() 失敗時無法 rollback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"dbx/database"
+)
+
+// Table 記錄已執行的 migration 的表格，是一般的直式表格，屬性有 Name 與 AppliedAt
+const Table = "schema_migrations"
+
+// ErrIrreversible 要還原的 migration 沒有 Down
+var ErrIrreversible = errors.New("migrate: migration has no Down")
+
+// Step 是 migration 的一個步驟，在 tx 內執行
+type Step func(ctx context.Context, tx *database.Tx) error
+
+type Migration struct {
+	Name string // 唯一，依字串排序決定執行順序，通常以數字開頭，例如 "0001_member"
+	Up   Step
+	Down Step // nil 表示不能還原
+}
+
+// Status 是 Migrator.Status() 傳回的每個 migration 的狀態
+type Status struct {
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+type Migrator struct {
+	db         *database.Db
+	migrations []Migration
+}
+
+// New 檢查 migrations 並依 Name 排序, 不會動到資料庫
+func New(db *database.Db, migrations ...Migration) (*Migrator, error) {
+	ms := append([]Migration{}, migrations...)
+	sort.SliceStable(ms, func(i, j int) bool { return ms[i].Name < ms[j].Name })
+	for i, m := range ms {
+		if m.Name == "" || m.Up == nil {
+			return nil, fmt.Errorf("migrate: migration %q must have Name and Up", m.Name)
+		}
+		if i > 0 && ms[i-1].Name == m.Name {
+			return nil, fmt.Errorf("migrate: duplicate migration %q", m.Name)
+		}
+	}
+	return &Migrator{db: db, migrations: ms}, nil
+}
+
+// Up 依序執行還沒執行過的 migration, 傳回這次執行的 Name
+func (m *Migrator) Up(ctx context.Context) ([]string, error) {
+	done := []string{}
+	if err := m.db.CreateTbCtx(ctx, Table, false); err != nil {
+		return done, err
+	}
+	for _, mig := range m.migrations {
+		mig := mig
+		applied := false
+		err := m.db.Tx(ctx, func(tx *database.Tx) error {
+			rec, err := record(ctx, tx, mig.Name)
+			if err != nil || rec != nil { // 別人已經執行過了
+				return err
+			}
+			if err := mig.Up(ctx, tx); err != nil {
+				return err
+			}
+			applied = true
+			_, err = tx.MapInsertCtx(ctx, Table, map[string]interface{}{"Name": mig.Name, "AppliedAt": time.Now()})
+			return err
+		})
+		if err != nil {
+			return done, fmt.Errorf("migrate: %s up: %w", mig.Name, err)
+		}
+		if applied {
+			done = append(done, mig.Name)
+		}
+	}
+	return done, nil
+}
+
+// Down 從最後一個開始還原 steps 個已執行的 migration, steps <= 0 表示全部，傳回這次還原的 Name
+func (m *Migrator) Down(ctx context.Context, steps int) ([]string, error) {
+	done := []string{}
+	if err := m.db.CreateTbCtx(ctx, Table, false); err != nil {
+		return done, err
+	}
+	for i := len(m.migrations) - 1; i >= 0 && (steps <= 0 || len(done) < steps); i-- {
+		mig := m.migrations[i]
+		reverted := false
+		err := m.db.Tx(ctx, func(tx *database.Tx) error {
+			rec, err := record(ctx, tx, mig.Name)
+			if err != nil || rec == nil { // 沒執行過
+				return err
+			}
+			if mig.Down == nil {
+				return ErrIrreversible
+			}
+			if err := mig.Down(ctx, tx); err != nil {
+				return err
+			}
+			reverted = true
+			return tx.DelCtx(ctx, Table, rec["Id"].(int))
+		})
+		if err != nil {
+			return done, fmt.Errorf("migrate: %s down: %w", mig.Name, err)
+		}
+		if reverted {
+			done = append(done, mig.Name)
+		}
+	}
+	return done, nil
+}
+
+// Status 傳回每個 migration 是否已執行，依 Name 排序
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	if err := m.db.CreateTbCtx(ctx, Table, false); err != nil {
+		return nil, err
+	}
+	items, err := m.db.FindAllCtx(ctx, Table)
+	if err != nil {
+		return nil, err
+	}
+	applied := map[string]time.Time{}
+	for _, item := range items {
+		name, _ := item["Name"].(string)
+		at, _ := item["AppliedAt"].(time.Time)
+		applied[name] = at
+	}
+	res := make([]Status, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		at, ok := applied[mig.Name]
+		res = append(res, Status{Name: mig.Name, Applied: ok, AppliedAt: at})
+	}
+	return res, nil
+}
+
+// record 傳回 name 的執行記錄，沒執行過傳回 nil
+func record(ctx context.Context, tx *database.Tx, name string) (map[string]interface{}, error) {
+	items, err := tx.FindWhereCtx(ctx, Table, database.Attr("Name").Eq(name))
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	return items[0], nil
+}
+
+// Steps 依序執行多個步驟
+func Steps(steps ...Step) Step {
+	return func(ctx context.Context, tx *database.Tx) error {
+		for _, step := range steps {
+			if err := step(ctx, tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// CreateTb 建立表格，已存在仍成功
+func CreateTb(tb string) Step {
+	return func(ctx context.Context, tx *database.Tx) error {
+		return tx.CreateTbCtx(ctx, tb, false)
+	}
+}
+
+// DropTb 刪除表格
+func DropTb(tb string) Step {
+	return func(ctx context.Context, tx *database.Tx) error {
+		return tx.DropTbCtx(ctx, tb)
+	}
+}
+
+// RenameAttr 見 database.Db.RenameAttr()
+func RenameAttr(tb, from, to string) Step {
+	return func(ctx context.Context, tx *database.Tx) error {
+		_, err := tx.RenameAttrCtx(ctx, tb, from, to)
+		return err
+	}
+}
+
+// RetypeAttr 見 database.Db.RetypeAttr()
+func RetypeAttr(tb, attr, typ string) Step {
+	return func(ctx context.Context, tx *database.Tx) error {
+		_, err := tx.RetypeAttrCtx(ctx, tb, attr, typ)
+		return err
+	}
+}
+
+// DefaultAttr 見 database.Db.DefaultAttr()
+func DefaultAttr(tb, attr string, v interface{}) Step {
+	return func(ctx context.Context, tx *database.Tx) error {
+		_, err := tx.DefaultAttrCtx(ctx, tb, attr, v)
+		return err
+	}
+}
+
+// DropAttr 見 database.Db.DropAttr()
+func DropAttr(tb, attr string) Step {
+	return func(ctx context.Context, tx *database.Tx) error {
+		_, err := tx.DropAttrCtx(ctx, tb, attr)
+		return err
+	}
+}
@@ -0,0 +1,153 @@
+package database
+
+// Gets() 每次都把整個表格讀出來，列表的 API 只需要一頁，所以有 GetsPage(), 例如:
+//   page := db.GetsPage("member", database.PageOpts{Limit: 20, OrderBy: "Age", Desc: true, Attrs: []string{"Name", "Age"}})
+//   page.Items  這一頁的物件，只有 Id 與 Attrs 指定的屬性
+//   page.Total  符合 Filter 的物件總數
+// 換頁有兩種方式:
+//   Offset      PageOpts{Limit: 20, Offset: 40}, 任何排序都可以用
+//   After       PageOpts{Limit: 20, After: page.Next}, 只能依 ObjId 排序，但不受新增/刪除影響，且大表格也一樣快
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type PageOpts struct {
+	Filter  Filter   // 零值不過濾
+	Limit   int      // 每頁幾個物件，0 表示不限
+	Offset  int      // 略過前面幾個物件
+	After   int      // keyset cursor, 從 ObjId 在 After 之後的物件開始，通常是上一頁的 Page.Next
+	OrderBy string   // 依哪個屬性排序，"" 表示依 ObjId; 數字與時間依 Typ 轉型後排序
+	Desc    bool     // 由大到小
+	Attrs   []string // 只讀出這些屬性，nil 表示全部
+}
+
+type Page struct {
+	Items []map[string]interface{}
+	Total int  // 符合 Filter 的物件總數，不受 Limit/Offset/After 影響
+	More  bool // 後面還有物件
+	Next  int  // 依 ObjId 排序且 More 時，下一頁的 After
+}
+
+// GetsPage 出錯時傳回空的 Page, 需要錯誤請用 FindPage()
+func (db *Db) GetsPage(tb string, opts PageOpts) Page {
+	return db.GetsPageCtx(context.Background(), tb, opts)
+}
+
+func (db *Db) GetsPageCtx(ctx context.Context, tb string, opts PageOpts) Page {
+	page, err := db.FindPageCtx(ctx, tb, opts)
+	if err != nil {
+		db.logf("database.GetsPage() %s\n", err.Error())
+		return Page{Items: []map[string]interface{}{}}
+	}
+	return page
+}
+
+// FindPage 同 GetsPage()
+func (db *Db) FindPage(tb string, opts PageOpts) (Page, error) {
+	return db.FindPageCtx(context.Background(), tb, opts)
+}
+
+func (db *Db) FindPageCtx(ctx context.Context, tb string, opts PageOpts) (Page, error) {
+	page := Page{Items: []map[string]interface{}{}}
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return page, err
+	}
+	if opts.Limit < 0 || opts.Offset < 0 {
+		return page, fmt.Errorf("GetsPage(%s): negative Limit or Offset", tb)
+	}
+	byId := opts.OrderBy == "" || opts.OrderBy == "Id" || opts.OrderBy == "ObjId"
+	if opts.After > 0 && !byId {
+		return page, fmt.Errorf("GetsPage(%s): After can only be used when ordering by ObjId", tb)
+	}
+	where, args := opts.Filter.where(db.Dialect(), name)
+	where = fmt.Sprintf("(%s) AND %s", where, db.aliveCond(name))
+
+	sql := fmt.Sprintf(`SELECT COUNT(DISTINCT ObjId) FROM %s WHERE %s;`, name, where)
+	if err := db.x().QueryRowxContext(ctx, db.rebind(sql), args...).Scan(&page.Total); err != nil {
+		return page, queryError(name, sql, err)
+	}
+
+	// 先找出這一頁的 ObjId, 多拿一個來判斷後面還有沒有
+	desc := ""
+	if opts.Desc {
+		desc = " DESC"
+	}
+	var limit int64 = math.MaxInt64
+	if opts.Limit > 0 {
+		limit = int64(opts.Limit) + 1
+	}
+	if byId {
+		if opts.After > 0 {
+			op := ">"
+			if opts.Desc {
+				op = "<"
+			}
+			where = fmt.Sprintf("(%s) AND ObjId%s?", where, op)
+			args = append(args, opts.After)
+		}
+		sql = fmt.Sprintf(`SELECT DISTINCT ObjId FROM %s WHERE %s ORDER BY ObjId%s LIMIT ? OFFSET ?;`, name, where, desc)
+	} else {
+		// 沒有這個屬性的物件也要列出來，所以用 LEFT JOIN
+		d := db.Dialect()
+		sql = fmt.Sprintf(`SELECT o.ObjId FROM (SELECT DISTINCT ObjId FROM %s WHERE %s) o LEFT JOIN %s s ON s.ObjId=o.ObjId AND s.Attr=? `+
+			`ORDER BY %s%s, %s%s, s.Val%s, o.ObjId%s LIMIT ? OFFSET ?;`,
+			name, where, name, typedVal(d, "number"), desc, typedVal(d, "time"), desc, desc, desc)
+		args = append(args, opts.OrderBy)
+	}
+	args = append(args, limit, opts.Offset)
+	ids := []int{}
+	if err := sqlx.SelectContext(ctx, db.x(), &ids, db.rebind(sql), args...); err != nil {
+		return page, queryError(name, sql, err)
+	}
+	if opts.Limit > 0 && len(ids) > opts.Limit {
+		ids = ids[:opts.Limit]
+		page.More = true
+		if byId {
+			page.Next = ids[len(ids)-1]
+		}
+	}
+	if len(ids) == 0 {
+		return page, nil
+	}
+
+	// 再讀出這些物件，依照上面的順序排好
+	items := make(map[int]map[string]interface{}, len(ids))
+	args = make([]interface{}, 0, len(ids)+len(opts.Attrs))
+	for _, id := range ids {
+		items[id] = map[string]interface{}{"Id": id} // 沒有任何 Attrs 的物件也要有 Id
+		args = append(args, id)
+	}
+	sql = fmt.Sprintf(`SELECT ObjId,Attr,Val,Typ FROM %s WHERE ObjId IN (?%s)`, name, strings.Repeat(",?", len(ids)-1))
+	if opts.Attrs != nil {
+		if len(opts.Attrs) == 0 {
+			sql += " AND 1=0"
+		} else {
+			sql += fmt.Sprintf(" AND Attr IN (?%s)", strings.Repeat(",?", len(opts.Attrs)-1))
+			for _, attr := range opts.Attrs {
+				args = append(args, attr)
+			}
+		}
+	}
+	sql += " ORDER BY ObjId,Id;"
+	err = db.scanObjs(ctx, name, sql, args, func(item map[string]interface{}) error {
+		id := item["Id"].(int)
+		for k, v := range item {
+			items[id][k] = v
+		}
+		return nil
+	})
+	if err != nil {
+		return page, err
+	}
+	for _, id := range ids {
+		page.Items = append(page.Items, items[id])
+	}
+	return page, nil
+}
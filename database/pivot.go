@@ -0,0 +1,232 @@
+package database
+
+// 直式表格很多查詢不好寫，報表工具也看不懂，所以可以產生橫式的 VIEW, 每個物件一列，每個屬性一欄:
+//   err := db.CreatePivotView("member", []string{"Name", "Age"}, "member_h")
+//   SELECT Name FROM member_h WHERE Age > 30;
+// 產生的 SQL 像這樣，Id 就是 ObjId:
+//   SELECT ObjId AS Id,
+//       MAX(CASE WHEN Attr='Name' THEN Val END) AS Name,
+//       MAX(CASE WHEN Attr='Age' AND Typ='int' THEN CAST(Val AS INTEGER) END) AS Age
+//   FROM member GROUP BY ObjId
+// 欄位的型態依表格的 Schema 決定，沒有 Schema 時看資料，所有物件的 Typ 都相同才轉型，否則保持字串
+// 資料很多時 VIEW 每次查詢都要重算，可以加上 Materialize() 建立真的表格，資料變動後再呼叫 RefreshPivot() 重建
+// 定義記錄在 dbx_pivot 表格，RefreshPivot() 會依照新的資料重新決定欄位與型態
+
+import (
+	"context"
+	dbsql "database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const pivotTable = "dbx_pivot"
+
+// PivotOption 調整 CreatePivotView() 的行為
+type PivotOption func(o *pivotOpts)
+
+type pivotOpts struct {
+	materialize bool
+}
+
+// Materialize 建立真的表格而不是 VIEW
+func Materialize() PivotOption {
+	return func(o *pivotOpts) {
+		o.materialize = true
+	}
+}
+
+// pivotDef 記錄在 dbx_pivot 的定義
+type pivotDef struct {
+	Name         string `db:"Name"`
+	Tb           string `db:"Tb"`
+	Attrs        string `db:"Attrs"` // JSON, null 表示所有屬性
+	Materialized bool   `db:"Materialized"`
+}
+
+// CreatePivotView 依 tb 產生名為 view 的橫式 VIEW, attrs 是要轉成欄位的屬性，nil 表示目前所有的屬性
+// 屬性名稱要能當成欄位名稱(同表格名稱的規則), 已存在的 view 會被取代
+func (db *Db) CreatePivotView(tb string, attrs []string, view string, opts ...PivotOption) error {
+	return db.CreatePivotViewCtx(context.Background(), tb, attrs, view, opts...)
+}
+
+func (db *Db) CreatePivotViewCtx(ctx context.Context, tb string, attrs []string, view string, opts ...PivotOption) error {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return err
+	}
+	if _, err := ParseIdent(view); err != nil {
+		return err
+	}
+	o := pivotOpts{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	b, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+	def := pivotDef{Name: view, Tb: string(name), Attrs: string(b), Materialized: o.materialize}
+	return db.atomic(ctx, func(db *Db) error {
+		if err := db.dropPivot(ctx, view); err != nil {
+			return err
+		}
+		return db.buildPivot(ctx, def)
+	})
+}
+
+// RefreshPivot 依照目前的資料重建 CreatePivotView() 產生的 VIEW 或表格
+func (db *Db) RefreshPivot(view string) error {
+	return db.RefreshPivotCtx(context.Background(), view)
+}
+
+func (db *Db) RefreshPivotCtx(ctx context.Context, view string) error {
+	if _, err := ParseIdent(view); err != nil {
+		return err
+	}
+	return db.atomic(ctx, func(db *Db) error {
+		if err := db.createPivotTb(ctx); err != nil {
+			return err
+		}
+		def := pivotDef{}
+		sql := "SELECT Name, Tb, Attrs, Materialized FROM " + pivotTable + " WHERE Name=?;"
+		err := db.x().QueryRowxContext(ctx, db.rebind(sql), view).StructScan(&def)
+		if errors.Is(err, dbsql.ErrNoRows) {
+			return fmt.Errorf("RefreshPivot(%s): %w", view, ErrNotFound)
+		} else if err != nil {
+			return queryError(pivotTable, sql, err)
+		}
+		if err := db.dropPivot(ctx, view); err != nil {
+			return err
+		}
+		return db.buildPivot(ctx, def)
+	})
+}
+
+// DropPivotView 刪除 CreatePivotView() 產生的 VIEW 或表格
+func (db *Db) DropPivotView(view string) error {
+	return db.DropPivotViewCtx(context.Background(), view)
+}
+
+func (db *Db) DropPivotViewCtx(ctx context.Context, view string) error {
+	if _, err := ParseIdent(view); err != nil {
+		return err
+	}
+	return db.atomic(ctx, func(db *Db) error {
+		return db.dropPivot(ctx, view)
+	})
+}
+
+// createPivotTb 建立 dbx_pivot, 已存在則略過
+func (db *Db) createPivotTb(ctx context.Context) error {
+	sql := "CREATE TABLE IF NOT EXISTS " + pivotTable + " ( Name VARCHAR(64) PRIMARY KEY, Tb VARCHAR(64) NOT NULL, Attrs TEXT NOT NULL, Materialized BOOLEAN NOT NULL );"
+	_, err := db.x().ExecContext(ctx, sql)
+	return queryError(pivotTable, sql, err)
+}
+
+// dropPivot 刪除舊的 VIEW 或表格與 dbx_pivot 的記錄，沒有記錄的表示不是我們建立的，不要動
+func (db *Db) dropPivot(ctx context.Context, view string) error {
+	if err := db.createPivotTb(ctx); err != nil {
+		return err
+	}
+	materialized := false
+	sql := "SELECT Materialized FROM " + pivotTable + " WHERE Name=?;"
+	err := db.x().QueryRowxContext(ctx, db.rebind(sql), view).Scan(&materialized)
+	if errors.Is(err, dbsql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return queryError(pivotTable, sql, err)
+	}
+	sql = "DROP VIEW IF EXISTS " + view + ";"
+	if materialized {
+		sql = "DROP TABLE IF EXISTS " + view + ";"
+	}
+	if _, err := db.x().ExecContext(ctx, sql); err != nil {
+		return queryError(Ident(view), sql, err)
+	}
+	sql = "DELETE FROM " + pivotTable + " WHERE Name=?;"
+	_, err = db.x().ExecContext(ctx, db.rebind(sql), view)
+	return queryError(pivotTable, sql, err)
+}
+
+// buildPivot 建立 VIEW 或表格，並把定義寫入 dbx_pivot
+func (db *Db) buildPivot(ctx context.Context, def pivotDef) error {
+	tb := Ident(def.Tb)
+	attrs := []string(nil)
+	if err := json.Unmarshal([]byte(def.Attrs), &attrs); err != nil {
+		return err
+	}
+	if attrs == nil {
+		sql := fmt.Sprintf("SELECT DISTINCT Attr FROM %s WHERE Attr<>'Id' ORDER BY Attr;", tb)
+		if err := sqlx.SelectContext(ctx, db.x(), &attrs, sql); err != nil {
+			return queryError(tb, sql, err)
+		}
+	}
+	typs, err := db.pivotTyps(ctx, tb, attrs)
+	if err != nil {
+		return err
+	}
+
+	d := db.Dialect()
+	cols := []string{"ObjId AS Id"}
+	for _, attr := range attrs {
+		if _, err := ParseIdent(attr); err != nil || attr == "Id" {
+			return fmt.Errorf("CreatePivotView(%s): attribute %q cannot be a column name", tb, attr)
+		}
+		cond := "Attr=" + d.Quote(attr)
+		expr := "Val"
+		if typ := typs[attr]; typ != "" {
+			if col := d.Column("Val", typ); col != "Val" { // 只轉型 Typ 相同的資料，其他為 NULL
+				cond += " AND Typ=" + d.Quote(typ)
+				expr = col
+			}
+		}
+		cols = append(cols, fmt.Sprintf("MAX(CASE WHEN %s THEN %s END) AS %s", cond, expr, attr))
+	}
+	sel := fmt.Sprintf("SELECT %s FROM %s GROUP BY ObjId", strings.Join(cols, ", "), tb)
+
+	sql := fmt.Sprintf("CREATE VIEW %s AS %s;", def.Name, sel)
+	if def.Materialized {
+		sql = fmt.Sprintf("CREATE TABLE %s AS %s;", def.Name, sel)
+	}
+	if _, err := db.x().ExecContext(ctx, sql); err != nil {
+		return queryError(tb, sql, err)
+	}
+	sql = "INSERT INTO " + pivotTable + " (Name, Tb, Attrs, Materialized) VALUES (?,?,?,?);"
+	_, err = db.x().ExecContext(ctx, db.rebind(sql), def.Name, def.Tb, def.Attrs, def.Materialized)
+	return queryError(pivotTable, sql, err)
+}
+
+// pivotTyps 決定每個屬性的欄位型態: 有 Schema 就用 Schema 的 Typ, 否則所有物件的 Typ 都相同(不算 nil) 才用該 Typ
+func (db *Db) pivotTyps(ctx context.Context, tb Ident, attrs []string) (map[string]string, error) {
+	typs := map[string]string{}
+	rows := []struct {
+		Attr string `db:"Attr"`
+		Typ  string `db:"Typ"`
+	}{}
+	sql := fmt.Sprintf("SELECT DISTINCT Attr, Typ FROM %s WHERE Typ<>'nil';", tb)
+	if err := sqlx.SelectContext(ctx, db.x(), &rows, sql); err != nil {
+		return nil, queryError(tb, sql, err)
+	}
+	mixed := map[string]bool{}
+	for _, r := range rows {
+		if old, ok := typs[r.Attr]; ok && old != r.Typ {
+			mixed[r.Attr] = true
+		}
+		typs[r.Attr] = r.Typ
+	}
+	for attr := range mixed {
+		typs[attr] = ""
+	}
+	if s := db.schemaOf(tb); s != nil {
+		for _, attr := range attrs {
+			if spec := s.attr(attr); spec != nil && spec.Typ != "" {
+				typs[attr] = spec.Typ
+			}
+		}
+	}
+	return typs, nil
+}
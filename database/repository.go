@@ -0,0 +1,196 @@
+package database
+
+// Repository 把一個表格綁定到某個 struct 型態，
+// Get()/Gets() 拿到的 map[string]interface{} 直接轉回 struct, 省得每次自己呼叫 mapstruct.Decode()
+// 用法:
+//   repo, err := db.Repository("demo", Member{})
+//   m := Member{Name: "Simba"}
+//   err = repo.Save(&m)       // m.Id 會填入新的 ObjId
+//   err = repo.Load(m.Id, &m)
+//   all := []Member{}
+//   err = repo.LoadAll(&all)
+// 因為 go1.14 沒有泛型，所以跟 sqlx 的 Get()/Select() 一樣傳指標進去
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	ms "dbx/mapstruct"
+	t "dbx/time"
+)
+
+type Repository struct {
+	db  *Db
+	tb  string
+	typ reflect.Type
+}
+
+// Repository model 可以是 struct 或指向 struct 的指標，只用來取得型態
+func (db *Db) Repository(tb string, model interface{}) (*Repository, error) {
+	if _, err := ParseIdent(tb); err != nil {
+		return nil, err
+	}
+	v, err := structValue(model)
+	if err != nil {
+		return nil, err
+	}
+	return &Repository{db: db, tb: tb, typ: v.Type()}, nil
+}
+
+// Load 讀出 ObjId = id 的物件，out 必須是 *T
+func (r *Repository) Load(id int, out interface{}) error {
+	return r.LoadCtx(context.Background(), id, out)
+}
+
+func (r *Repository) LoadCtx(ctx context.Context, id int, out interface{}) error {
+	if err := r.check(out, r.typ); err != nil {
+		return err
+	}
+	item, err := r.db.FindCtx(ctx, r.tb, id)
+	if err != nil {
+		return err
+	}
+	if err := decodeStruct(item, out); err != nil {
+		return err
+	}
+	return r.afterLoad(ctx, out)
+}
+
+// LoadAll 讀出所有物件，out 必須是 *[]T
+func (r *Repository) LoadAll(out interface{}) error {
+	return r.LoadAllCtx(context.Background(), out)
+}
+
+func (r *Repository) LoadAllCtx(ctx context.Context, out interface{}) error {
+	if err := r.check(out, reflect.SliceOf(r.typ)); err != nil {
+		return err
+	}
+	items, err := r.db.FindAllCtx(ctx, r.tb)
+	if err != nil {
+		return err
+	}
+	res := reflect.MakeSlice(reflect.SliceOf(r.typ), len(items), len(items))
+	for i, item := range items {
+		if err := decodeStruct(item, res.Index(i).Addr().Interface()); err != nil {
+			return err
+		}
+		if err := r.afterLoad(ctx, res.Index(i).Addr().Interface()); err != nil {
+			return err
+		}
+	}
+	reflect.ValueOf(out).Elem().Set(res)
+	return nil
+}
+
+// Save in 必須是 *T, Id 為 0 或不存在時 Insert, 並把新的 ObjId 寫回 Id 欄位，否則 Update
+func (r *Repository) Save(in interface{}) error {
+	return r.SaveCtx(context.Background(), in)
+}
+
+func (r *Repository) SaveCtx(ctx context.Context, in interface{}) error {
+	if err := r.check(in, r.typ); err != nil {
+		return err
+	}
+	if id := getId(in); id > 0 {
+		_, err := r.db.FindCtx(ctx, r.tb, id)
+		if err == nil {
+			return r.db.UpdateCtx(ctx, r.tb, in)
+		} else if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	item, err := r.db.InsertCtx(ctx, r.tb, in)
+	if err != nil {
+		return err
+	}
+	id, ok := item["Id"].(int)
+	if !ok {
+		return fmt.Errorf("%s: inserted object has no Id", r.tb)
+	}
+	if f := reflect.ValueOf(in).Elem().FieldByName("Id"); f.IsValid() && f.CanSet() {
+		switch f.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			f.SetInt(int64(id))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			f.SetUint(uint64(id))
+		}
+	}
+	return nil
+}
+
+// afterLoad 表格沒有 Schema.Model 時呼叫 out 的 AfterLoad, 有的話 Find 系列已經呼叫過了
+func (r *Repository) afterLoad(ctx context.Context, out interface{}) error {
+	if r.db.hooked(Ident(r.tb), afterLoaderType) != nil {
+		return nil
+	}
+	return afterLoad(ctx, out)
+}
+
+func (r *Repository) Delete(id int) error {
+	return r.DeleteCtx(context.Background(), id)
+}
+
+func (r *Repository) DeleteCtx(ctx context.Context, id int) error {
+	return r.db.DelCtx(ctx, r.tb, id)
+}
+
+// check 確認 p 是指向 typ 的指標
+func (r *Repository) check(p interface{}, typ reflect.Type) error {
+	if reflect.TypeOf(p) != reflect.PtrTo(typ) {
+		return fmt.Errorf("%s: expect *%s, got %T", r.tb, typ, p)
+	}
+	if reflect.ValueOf(p).IsNil() {
+		return fmt.Errorf("%s: nil %T", r.tb, p)
+	}
+	return nil
+}
+
+// decodeStruct 用 mapstruct 把 Get() 的結果轉成 struct
+// Val 存的都是字串，所以要 WeaklyTypedInput, 另外補上時間相關的轉換
+func decodeStruct(item map[string]interface{}, out interface{}) error {
+	dec, err := ms.NewDecoder(&ms.DecoderConfig{
+		DecodeHook: ms.ComposeDecodeHookFunc(
+			timeHook,
+			ms.StringToTimeDurationHookFunc(),
+		),
+		WeaklyTypedInput: true,
+		Result:           out,
+	})
+	if err != nil {
+		return err
+	}
+	return dec.Decode(item)
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	dbxTimeType = reflect.TypeOf(t.Time{})
+)
+
+// timeHook 處理 time.Time 與 dbx/time.Time 之間，以及字串轉時間
+func timeHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if to != timeType && to != dbxTimeType {
+		return data, nil
+	}
+	var tt time.Time
+	switch v := data.(type) {
+	case time.Time:
+		tt = v
+	case t.Time:
+		tt = time.Time(v)
+	case string:
+		var err error
+		if tt, err = parseTime(v); err != nil {
+			return nil, err
+		}
+	default:
+		return data, nil
+	}
+	if to == dbxTimeType {
+		return t.Time(tt), nil
+	}
+	return tt, nil
+}
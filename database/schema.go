@@ -0,0 +1,408 @@
+package database
+
+// 直式表格什麼都能存，同一個屬性可能這筆是 int 那筆是 string, 必填的屬性也可能漏掉，
+// 所以可以替表格註冊 Schema (選用), 註冊後 Insert/Update/PatchUpdate/UnsetAttrs/Map* 寫入前都會檢查，
+// 所有不合格的屬性一起放在 *ValidationError 傳回, 用法:
+//   err := db.SetSchema("member", &database.Schema{Attrs: []database.AttrSpec{
+//       {Name: "Name", Typ: "string", Required: true, Unique: true},
+//       {Name: "Age", Typ: "int", Min: 0, Max: 150},
+//       {Name: "Level", Typ: "string", Enum: []interface{}{"gold", "silver"}, Default: "silver"},
+//   }})
+// 或由 struct 產生，約束寫在 dbx tag:
+//   type Member struct {
+//       Id    int
+//       Name  string `dbx:"required,unique"`
+//       Age   int    `dbx:"min=0,max=150"`
+//       Level string `dbx:"enum=gold|silver,default=silver"`
+//   }
+//   s, err := database.SchemaOf(Member{})
+// 數字的 Typ 不同但可以無損轉換時(例如 json 解出來的 float64 3 存到 int 屬性) 會自動轉成 Schema 的 Typ
+// 沒列在 Schema 的屬性不檢查
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type Schema struct {
+	Attrs []AttrSpec
+	Model interface{} // struct, Map* 與 Get 系列用它呼叫 BeforeInsert 等 hooks, 見 hooks.go
+}
+
+// AttrSpec 一個屬性的約束
+type AttrSpec struct {
+	Name     string
+	Typ      string        // 同 Typ 欄位, 如 "int", "string", "json", 空字串表示不限
+	Required bool          // Insert 時必須有值(不能是 nil, struct 則不能是零值), 也不能被 UnsetAttrs() 刪除
+	Default  interface{}   // Insert 時沒給(struct 則是零值) 就用這個值, nil 表示沒有預設值
+	Enum     []interface{} // 只能是其中之一
+	Min, Max interface{}   // 數字的範圍, nil 表示不限
+	Unique   bool          // 同一個表格內不能有兩個物件的值相同
+}
+
+// ValidationError 寫入的資料不符合 Schema, Fields 是每個不合格的屬性
+type ValidationError struct {
+	Table  string
+	Fields []FieldError
+}
+
+type FieldError struct {
+	Attr string
+	Msg  string
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Attr + ": " + f.Msg
+	}
+	return fmt.Sprintf("database: invalid %s: %s", e.Table, strings.Join(msgs, "; "))
+}
+
+func (e *ValidationError) add(attr, format string, v ...interface{}) {
+	e.Fields = append(e.Fields, FieldError{Attr: attr, Msg: fmt.Sprintf(format, v...)})
+}
+
+// schemas 表格名稱對應的 Schema
+type schemas struct {
+	mu sync.RWMutex
+	m  map[Ident]*Schema
+}
+
+// SetSchema 註冊表格的 Schema, s = nil 則取消, 註冊後請不要再修改 s
+func (db *Db) SetSchema(tb string, s *Schema) error {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return err
+	}
+	if s != nil {
+		if err := s.valid(name); err != nil {
+			return err
+		}
+		if s.Model != nil {
+			if _, err := structValue(s.Model); err != nil {
+				return fmt.Errorf("SetSchema(%s): Model: %s", tb, err.Error())
+			}
+		}
+	}
+	if db.schemas == nil {
+		db.schemas = &schemas{m: map[Ident]*Schema{}}
+	}
+	db.schemas.mu.Lock()
+	defer db.schemas.mu.Unlock()
+	if s == nil {
+		delete(db.schemas.m, name)
+	} else {
+		db.schemas.m[name] = s
+	}
+	return nil
+}
+
+// Schema 傳回表格的 Schema, 沒有註冊則傳回 nil
+func (db *Db) Schema(tb string) *Schema {
+	return db.schemaOf(Ident(tb))
+}
+
+func (db *Db) schemaOf(tb Ident) *Schema {
+	if db.schemas == nil {
+		return nil
+	}
+	db.schemas.mu.RLock()
+	defer db.schemas.mu.RUnlock()
+	return db.schemas.m[tb]
+}
+
+// SchemaOf 由 struct 的欄位產生 Schema, Typ 依欄位型態決定，其他約束寫在 dbx tag, 以逗號分隔:
+//   required, unique, default=值, min=數字, max=數字, enum=值1|值2
+// Id 與沒有匯出的欄位略過，dbx:"-" 也略過, Model 設為 model 的型態
+func SchemaOf(model interface{}) (*Schema, error) {
+	v, err := structValue(model)
+	if err != nil {
+		return nil, err
+	}
+	s := &Schema{Model: v.Interface()}
+	typ := v.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag := field.Tag.Get("dbx")
+		if field.Name == "Id" || field.PkgPath != "" || tag == "-" {
+			continue
+		}
+		spec := AttrSpec{Name: field.Name, Typ: typName(field.Type)}
+		for _, opt := range strings.Split(tag, ",") {
+			key, val := opt, ""
+			if i := strings.Index(opt, "="); i >= 0 {
+				key, val = opt[:i], opt[i+1:]
+			}
+			switch key {
+			case "":
+			case "required":
+				spec.Required = true
+			case "unique":
+				spec.Unique = true
+			case "default":
+				spec.Default, err = parseTagVal(spec.Typ, val)
+			case "min":
+				spec.Min, err = strconv.ParseFloat(val, 64)
+			case "max":
+				spec.Max, err = strconv.ParseFloat(val, 64)
+			case "enum":
+				for _, e := range strings.Split(val, "|") {
+					var ev interface{}
+					if ev, err = parseTagVal(spec.Typ, e); err != nil {
+						break
+					}
+					spec.Enum = append(spec.Enum, ev)
+				}
+			default:
+				err = fmt.Errorf("unknown option %q", key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("SchemaOf(%s): %s: %s", typ, field.Name, err.Error())
+			}
+		}
+		s.Attrs = append(s.Attrs, spec)
+	}
+	return s, nil
+}
+
+// parseTagVal 把 tag 內的字串依 Typ 還原
+func parseTagVal(typ, s string) (interface{}, error) {
+	switch typ {
+	case "":
+		return s, nil
+	case "json":
+		return decodeJSON(s)
+	}
+	c := lookupName(typ)
+	if c == nil {
+		return nil, fmt.Errorf("unknown Typ %q", typ)
+	}
+	return c.dec(s)
+}
+
+func (s *Schema) attr(name string) *AttrSpec {
+	for i := range s.Attrs {
+		if s.Attrs[i].Name == name {
+			return &s.Attrs[i]
+		}
+	}
+	return nil
+}
+
+// valid 檢查 Schema 本身是否正確，預設值也要符合約束
+func (s *Schema) valid(tb Ident) error {
+	verr := &ValidationError{Table: string(tb)}
+	seen := map[string]bool{}
+	for _, spec := range s.Attrs {
+		switch {
+		case spec.Name == "" || spec.Name == "Id":
+			verr.add(spec.Name, "invalid attribute name")
+		case seen[spec.Name]:
+			verr.add(spec.Name, "duplicated")
+		case spec.Typ != "" && spec.Typ != "json" && lookupName(spec.Typ) == nil:
+			verr.add(spec.Name, "unknown Typ %q", spec.Typ)
+		}
+		seen[spec.Name] = true
+		if _, ok := toFloat(spec.Min); spec.Min != nil && !ok {
+			verr.add(spec.Name, "Min %v is not a number", spec.Min)
+		}
+		if _, ok := toFloat(spec.Max); spec.Max != nil && !ok {
+			verr.add(spec.Name, "Max %v is not a number", spec.Max)
+		}
+		if spec.Default != nil {
+			val, typ, err := encodeAttr(spec.Default)
+			if err == nil {
+				_, err = spec.check(Table{Attr: spec.Name, Val: val, Typ: typ})
+			}
+			if err != nil {
+				verr.add(spec.Name, "Default: %s", err.Error())
+			}
+		}
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// checkSchema 寫入前依表格的 Schema 檢查 rows, 沒有 Schema 則原封不動傳回
+// insert 時補上預設值並檢查必填，unset 是要刪除的屬性
+// 傳回的 rows 的 Typ 可能已經轉成 Schema 的 Typ
+func (db *Db) checkSchema(ctx context.Context, tb Ident, objId int, rows []Table, unset []string, insert bool) ([]Table, error) {
+	s := db.schemaOf(tb)
+	if s == nil {
+		return rows, nil
+	}
+	verr := &ValidationError{Table: string(tb)}
+	if insert {
+		seen := map[string]bool{}
+		for _, r := range rows {
+			seen[r.Attr] = true
+		}
+		for _, spec := range s.Attrs {
+			if seen[spec.Name] {
+				continue
+			}
+			if spec.Default != nil {
+				val, typ, _ := encodeAttr(spec.Default) // SetSchema() 時已經檢查過
+				rows = append(rows, Table{ObjId: objId, Attr: spec.Name, Val: val, Typ: typ})
+			} else if spec.Required {
+				verr.add(spec.Name, "is required")
+			}
+		}
+	}
+
+	res := make([]Table, 0, len(rows))
+	for _, r := range rows {
+		spec := s.attr(r.Attr)
+		if spec == nil {
+			res = append(res, r)
+			continue
+		}
+		r, err := spec.check(r)
+		if err != nil {
+			verr.add(r.Attr, "%s", err.Error())
+			continue
+		}
+		if spec.Unique && r.Typ != "nil" {
+			n := 0
+			sql := fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE Attr=? AND Val=? AND ObjId<>?;`, tb)
+			if err := db.x().QueryRowxContext(ctx, db.rebind(sql), r.Attr, r.Val, objId).Scan(&n); err != nil {
+				return nil, queryError(tb, sql, err)
+			}
+			if n > 0 {
+				verr.add(r.Attr, "%q already exists", r.Val)
+				continue
+			}
+		}
+		res = append(res, r)
+	}
+	for _, attr := range unset {
+		if spec := s.attr(attr); spec != nil && spec.Required {
+			verr.add(attr, "is required")
+		}
+	}
+	if len(verr.Fields) > 0 {
+		sort.SliceStable(verr.Fields, func(i, j int) bool { return verr.Fields[i].Attr < verr.Fields[j].Attr })
+		return nil, verr
+	}
+	return res, nil
+}
+
+// zeroAsMissing struct Insert 用，struct 每個欄位都會存，所以有 Default 或 Required 的屬性是零值時當成沒給
+func (db *Db) zeroAsMissing(tb Ident, rows []Table, v reflect.Value) ([]Table, error) {
+	s := db.schemaOf(tb)
+	if s == nil {
+		return rows, nil
+	}
+	set, err := structRows(0, v, true)
+	if err != nil {
+		return nil, err
+	}
+	given := make(map[string]bool, len(set))
+	for _, r := range set {
+		given[r.Attr] = true
+	}
+	res := make([]Table, 0, len(rows))
+	for _, r := range rows {
+		if spec := s.attr(r.Attr); spec != nil && (spec.Default != nil || spec.Required) && !given[r.Attr] {
+			continue
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// check 檢查一個屬性, Typ 不同時嘗試轉換
+func (spec *AttrSpec) check(r Table) (Table, error) {
+	if r.Typ == "nil" {
+		if spec.Required {
+			return r, fmt.Errorf("is required")
+		}
+		return r, nil
+	}
+	if spec.Typ != "" && r.Typ != spec.Typ {
+		val, err := convertVal(r, spec.Typ)
+		if err != nil {
+			return r, err
+		}
+		r.Val, r.Typ = val, spec.Typ
+	}
+	if len(spec.Enum) > 0 {
+		ok := false
+		for _, e := range spec.Enum {
+			if val, _, err := encodeAttr(e); err == nil && val == r.Val {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return r, fmt.Errorf("%q is not one of %v", r.Val, spec.Enum)
+		}
+	}
+	if spec.Min != nil || spec.Max != nil {
+		f, err := strconv.ParseFloat(r.Val, 64)
+		if err != nil {
+			return r, fmt.Errorf("%q is not a number", r.Val)
+		}
+		if min, ok := toFloat(spec.Min); ok && f < min {
+			return r, fmt.Errorf("%s is less than %v", r.Val, spec.Min)
+		}
+		if max, ok := toFloat(spec.Max); ok && f > max {
+			return r, fmt.Errorf("%s is greater than %v", r.Val, spec.Max)
+		}
+	}
+	return r, nil
+}
+
+// convertVal 數字之間可以無損轉換時，傳回轉成 typ 後的 Val
+func convertVal(r Table, typ string) (string, error) {
+	mismatch := fmt.Errorf("must be %s, got %s", typ, r.Typ)
+	c := lookupName(typ)
+	if c == nil || typ == "json" {
+		return "", mismatch
+	}
+	v := reflect.ValueOf(decodeAttr(r.Typ, r.Val))
+	if !v.IsValid() || !isNumber(v.Kind()) || !isNumber(c.typ.Kind()) {
+		return "", mismatch
+	}
+	if f, _ := toFloat(v.Interface()); f < 0 && isUint(c.typ.Kind()) {
+		return "", fmt.Errorf("cannot convert %s %s to %s", r.Typ, r.Val, typ)
+	}
+	cv := v.Convert(c.typ)
+	if cv.Convert(v.Type()).Interface() != v.Interface() {
+		return "", fmt.Errorf("cannot convert %s %s to %s", r.Typ, r.Val, typ)
+	}
+	return c.enc(cv)
+}
+
+func isUint(k reflect.Kind) bool {
+	return k >= reflect.Uint && k <= reflect.Uintptr
+}
+
+func isNumber(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Float64
+}
+
+// toFloat 任何數字型態轉成 float64
+func toFloat(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return 0, false
+	}
+	switch {
+	case rv.Kind() >= reflect.Int && rv.Kind() <= reflect.Int64:
+		return float64(rv.Int()), true
+	case isUint(rv.Kind()):
+		return float64(rv.Uint()), true
+	case rv.Kind() == reflect.Float32 || rv.Kind() == reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,70 @@
+package database
+
+// Schema 的 default 與 required 在 struct 的 Insert 也要有作用，struct 的零值欄位當成沒給
+
+import (
+	"errors"
+	"testing"
+)
+
+type schemaMember struct {
+	Id    int
+	Name  string `dbx:"required,unique"`
+	Age   int    `dbx:"min=0,max=150"`
+	Level string `dbx:"enum=gold|silver,default=silver"`
+}
+
+func schemaDb(t *testing.T) *Db {
+	db, err := Connect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Db.SetMaxOpenConns(1) // :memory: 每個連線是不同的資料庫
+	if err := db.CreateTb("demo", false); err != nil {
+		t.Fatal(err)
+	}
+	s, err := SchemaOf(schemaMember{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetSchema("demo", s); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestSchemaStructDefault(t *testing.T) {
+	db := schemaDb(t)
+	item, err := db.Insert("demo", schemaMember{Name: "z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item["Level"] != "silver" || item["Age"] != 0 {
+		t.Errorf("got %v, want Level silver, Age 0", item)
+	}
+	item, err = db.Insert("demo", &schemaMember{Name: "y", Level: "gold"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item["Level"] != "gold" {
+		t.Errorf("Level = %v, want gold", item["Level"])
+	}
+}
+
+func TestSchemaStructRequired(t *testing.T) {
+	db := schemaDb(t)
+	_, err := db.Insert("demo", schemaMember{Level: "gold"})
+	verr := &ValidationError{}
+	if !errors.As(err, &verr) || len(verr.Fields) != 1 || verr.Fields[0].Attr != "Name" {
+		t.Fatalf("Insert without Name: %v, want Name is required", err)
+	}
+	if items, err := db.FindAll("demo"); err != nil || len(items) != 0 {
+		t.Errorf("after failed Insert: %v, %v, want nothing stored", items, err)
+	}
+
+	// 其他的檢查照舊
+	_, err = db.Insert("demo", schemaMember{Name: "x", Level: "bronze", Age: 200})
+	if !errors.As(err, &verr) || len(verr.Fields) != 2 {
+		t.Fatalf("Insert with bad Level and Age: %v, want 2 errors", err)
+	}
+}
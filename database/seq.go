@@ -0,0 +1,68 @@
+package database
+
+// ObjId 的配置
+// 原本用 MAX(ObjId)+1, 兩個 goroutine 同時 Insert 會拿到同一個 ObjId, 屬性就混在一起了,
+// 所以改用 dbx_seq 表格記錄每個表格用到的 ObjId, 配置時在同一個交易內先 UPDATE 再讀出來，
+// UPDATE 會鎖住該筆資料，別人要等我們 commit 之後才能拿下一個號碼
+// 第一次使用的表格先 INSERT Id=0 的一筆(已存在則略過) 再 UPDATE, 不能 UPDATE 沒改到才 INSERT:
+// 兩個交易同時第一次配置時，postgres 後 INSERT 的會撞主鍵，MySQL 則兩邊互相等待而 deadlock
+// sqlite3 則在 Connect() 時指定 _txlock=immediate, 交易一開始就取得寫入鎖
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+const seqTable = "dbx_seq"
+
+// createSeq 建立 dbx_seq, 已存在則略過
+func (db *Db) createSeq(ctx context.Context) error {
+	sql := "CREATE TABLE IF NOT EXISTS " + seqTable + " ( Tb VARCHAR(64) PRIMARY KEY, Id INTEGER NOT NULL );"
+	_, err := db.x().ExecContext(ctx, sql)
+	return queryError(seqTable, sql, err)
+}
+
+// resetSeq 表格重建時，號碼從頭開始
+func (db *Db) resetSeq(ctx context.Context, tb Ident) error {
+	if err := db.createSeq(ctx); err != nil {
+		return err
+	}
+	sql := "DELETE FROM " + seqTable + " WHERE Tb=?;"
+	_, err := db.x().ExecContext(ctx, db.rebind(sql), string(tb))
+	return queryError(seqTable, sql, err)
+}
+
+// allocId 配置一個新的 ObjId, 必須在交易內呼叫 (見 atomic())
+// 號碼不會小於表格內現有的 MAX(ObjId)+1, 所以不經過 allocId 寫入的資料也不會撞號
+func (db *Db) allocId(ctx context.Context, tb Ident) (int, error) {
+	if db.tx == nil {
+		return 0, fmt.Errorf("allocId(%s) must run inside a transaction", tb)
+	}
+	sql := db.Dialect().InsertIgnore(seqTable, "Tb", "Id")
+	seed := func(db *Db) error {
+		_, err := db.x().ExecContext(ctx, db.rebind(sql), string(tb), 0)
+		return queryError(seqTable, sql, err)
+	}
+	// 在 savepoint 內試，postgres 的交易出錯後就不能再用，要先 rollback 到 savepoint 才能建立 dbx_seq
+	err := db.atomic(ctx, seed)
+	if errors.Is(err, ErrNoSuchTable) { // dbx_seq 不存在(自己建立的 Db{Db: ...}), 建立後再試一次
+		if err := db.createSeq(ctx); err != nil {
+			return 0, err
+		}
+		err = seed(db)
+	}
+	if err != nil {
+		return 0, err
+	}
+	max := fmt.Sprintf("(SELECT COALESCE(MAX(ObjId),0) FROM %s)", tb)
+	sql = fmt.Sprintf("UPDATE %s SET Id = CASE WHEN Id > %s THEN Id+1 ELSE %s+1 END WHERE Tb=?;", seqTable, max, max)
+	if _, err := db.x().ExecContext(ctx, db.rebind(sql), string(tb)); err != nil {
+		return 0, queryError(tb, sql, err)
+	}
+
+	id := 0
+	sql = "SELECT Id FROM " + seqTable + " WHERE Tb=?;"
+	err = db.x().QueryRowxContext(ctx, db.rebind(sql), string(tb)).Scan(&id)
+	return id, queryError(seqTable, sql, err)
+}
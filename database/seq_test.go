@@ -0,0 +1,124 @@
+package database
+
+// 很多個 goroutine 同時對同一個 sqlite 檔案 Insert, 每筆資料都要拿到不同的 ObjId, 屬性也不能混在一起
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestConcurrentInsert(t *testing.T) {
+	const workers, perWorker = 16, 25
+	dir, err := ioutil.TempDir("", "dbx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := Connect(filepath.Join(dir, "seq.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Db.Close()
+	if err := db.CreateTb("demo", true); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				if _, err := db.MapInsert("demo", map[string]interface{}{"Worker": w, "Seq": i}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	items, err := db.FindAll("demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := map[int]bool{}
+	seen := map[string]bool{}
+	for _, item := range items {
+		if len(item) != 4 { // Id, Worker, Seq, Version
+			t.Fatalf("attributes merged: %v", item)
+		}
+		ids[item["Id"].(int)] = true
+		seen[fmt.Sprint(item["Worker"], "/", item["Seq"])] = true
+	}
+	if len(items) != workers*perWorker || len(ids) != len(items) || len(seen) != len(items) {
+		t.Fatalf("%d objects, %d distinct ObjId, %d distinct inputs, want %d", len(items), len(ids), len(seen), workers*perWorker)
+	}
+}
+
+// 第一次配置時 dbx_seq 還沒有這個表格，號碼從現有的 MAX(ObjId)+1 開始
+func TestAllocIdFirstUse(t *testing.T) {
+	db, err := Connect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Db.SetMaxOpenConns(1) // :memory: 每個連線是不同的資料庫
+	if err := db.CreateTb("demo", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Db.Exec("INSERT INTO demo (ObjId,Attr,Val,Typ) VALUES (7,'Name','a','string');"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []int{8, 9} {
+		item, err := db.MapInsert("demo", map[string]interface{}{"Name": "b"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item["Id"] != want {
+			t.Errorf("Id = %v, want %d", item["Id"], want)
+		}
+	}
+}
+
+// 自己建立的 Db{Db: ...} 沒有 dbx_seq, 第一次 Insert 時在交易內建立
+func TestAllocIdWithoutSeq(t *testing.T) {
+	x, err := sqlx.Connect("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x.SetMaxOpenConns(1) // :memory: 每個連線是不同的資料庫
+	db := &Db{Db: x}
+	if err := db.CreateTb("demo", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Db.Exec("DROP TABLE IF EXISTS " + seqTable + ";"); err != nil {
+		t.Fatal(err)
+	}
+	err = db.Tx(context.Background(), func(tx *Tx) error {
+		for _, want := range []int{1, 2} {
+			item, err := tx.MapInsert("demo", map[string]interface{}{"Name": "a"})
+			if err != nil {
+				return err
+			}
+			if item["Id"] != want {
+				t.Errorf("Id = %v, want %d", item["Id"], want)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
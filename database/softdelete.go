@@ -0,0 +1,124 @@
+package database
+
+// Del()/DelsBy() 會直接刪掉資料，刪錯就救不回來，所以可以開啟 soft delete:
+//   err := db.EnableSoftDelete("member")
+//   err = db.Del("member", 1)                        // 只加上 DeletedAt 屬性(刪除的時間)
+//   db.Get("member", 1)                              // 讀取 API 都看不到已刪除的物件
+//   db.IncludeDeleted().Get("member", 1)             // 要看的話用 IncludeDeleted(), 會帶有 DeletedAt
+//   err = db.Restore("member", 1)                    // 拿掉 DeletedAt
+//   n, err := db.Purge("member", 30*24*time.Hour)    // 真的刪除 30 天前就刪除的物件
+// 刪除與復原跟 Update 一樣 Version 加 1, 之前讀出的物件 UpdateIfVersion() 會失敗
+// CreatePivotView() 產生的 VIEW 是直接查表格，不會略過已刪除的物件
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Tombstone 已刪除的物件會有這個屬性，值是刪除的時間
+const Tombstone = "DeletedAt"
+
+// EnableSoftDelete 讓 tb 的 Del()/DelsBy() 只標記為已刪除
+func (db *Db) EnableSoftDelete(tb string) error {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return err
+	}
+	if db.softDel == nil {
+		db.softDel = newTableSet()
+	}
+	db.softDel.set(name, true)
+	return nil
+}
+
+// DisableSoftDelete 恢復成直接刪除，已標記的物件仍然是已刪除, 需要時請用 Restore() 或 Purge()
+func (db *Db) DisableSoftDelete(tb string) {
+	if db.softDel != nil {
+		db.softDel.set(Ident(tb), false)
+	}
+}
+
+// IncludeDeleted 傳回一份會讀出已刪除物件的 Db
+func (db *Db) IncludeDeleted() *Db {
+	child := *db
+	child.withDeleted = true
+	return &child
+}
+
+// hidesDeleted 讀取 tb 時是否要略過已刪除的物件
+func (db *Db) hidesDeleted(tb Ident) bool {
+	return !db.withDeleted && db.softDel.has(tb)
+}
+
+// aliveCond 傳回排除已刪除物件的條件，不需要排除時為 "1=1"
+func (db *Db) aliveCond(tb Ident) string {
+	if !db.hidesDeleted(tb) {
+		return "1=1"
+	}
+	return fmt.Sprintf("ObjId NOT IN (SELECT ObjId FROM %s WHERE Attr=%s)", tb, db.Dialect().Quote(Tombstone))
+}
+
+// softDelete 在符合 where 且還沒刪除的物件加上 Tombstone
+func (db *Db) softDelete(ctx context.Context, tb Ident, where string, args []interface{}) error {
+	val, typ, err := encodeAttr(time.Now())
+	if err != nil {
+		return err
+	}
+	alive := fmt.Sprintf("(%s) AND ObjId NOT IN (SELECT ObjId FROM %s WHERE Attr=?)", where, tb)
+	args = append(append([]interface{}{}, args...), Tombstone)
+	return db.atomic(ctx, func(db *Db) error {
+		if err := db.bumpVersionsWhere(ctx, tb, alive, args); err != nil {
+			return err
+		}
+		return db.trackedAs(ctx, tb, EventDelete, where, args[:len(args)-1], func(db *Db) error {
+			sql := fmt.Sprintf("INSERT INTO %s (ObjId,Attr,Val,Typ) SELECT DISTINCT ObjId, ?, ?, ? FROM %s WHERE %s;", tb, tb, alive)
+			_, err := db.x().ExecContext(ctx, db.rebind(sql), append([]interface{}{Tombstone, val, typ}, args...)...)
+			return queryError(tb, sql, err)
+		})
+	})
+}
+
+// Restore 復原已刪除的物件，沒有刪除的物件不受影響
+func (db *Db) Restore(tb string, id int) error {
+	return db.RestoreCtx(context.Background(), tb, id)
+}
+
+func (db *Db) RestoreCtx(ctx context.Context, tb string, id int) error {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return err
+	}
+	return db.atomic(ctx, func(db *Db) error {
+		if err := db.bumpVersionsWhere(ctx, name, "ObjId=? AND Attr=?", []interface{}{id, Tombstone}); err != nil {
+			return err
+		}
+		return db.unsetAttrs(ctx, name, id, []string{Tombstone})
+	})
+}
+
+// Purge 真的刪除 olderThan 之前就已刪除的物件, olderThan = 0 表示所有已刪除的物件，傳回刪除的物件數
+func (db *Db) Purge(tb string, olderThan time.Duration) (int, error) {
+	return db.PurgeCtx(context.Background(), tb, olderThan)
+}
+
+func (db *Db) PurgeCtx(ctx context.Context, tb string, olderThan time.Duration) (int, error) {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return 0, err
+	}
+	where, args := Attr(Tombstone).Le(time.Now().Add(-olderThan)).where(db.Dialect(), name)
+	n := 0
+	err = db.atomic(ctx, func(db *Db) error {
+		sql := fmt.Sprintf("SELECT COUNT(DISTINCT ObjId) FROM %s WHERE %s;", name, where)
+		if err := db.x().QueryRowxContext(ctx, db.rebind(sql), args...).Scan(&n); err != nil {
+			return queryError(name, sql, err)
+		}
+		return db.tracked(ctx, name, where, args, func(db *Db) error {
+			sql := db.Dialect().Delete(name, where)
+			_, err := db.x().ExecContext(ctx, db.rebind(sql), args...)
+			return queryError(name, sql, err)
+		})
+	})
+	return n, err
+}
@@ -1,82 +1,151 @@
 package database
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"strconv"
-	"strings"
 )
 
+// input 可以是 struct 或指向 struct 的指標
 func (db *Db) Insert(tb string, input interface{}) (map[string]interface{}, error) {
-    getType := reflect.TypeOf(input)
-    getValue := reflect.ValueOf(input)
-	objId := db.NextId(tb)
+	return db.InsertCtx(context.Background(), tb, input)
+}
 
-	// 要知道的是，input 每個欄位，對表格來說都是一筆資料
-	sql := "INSERT INTO " + tb + " (ObjId,Attr,Val,Typ) VALUES "
-	// 透過 reflect.TypeOf().Field(i) 可以 traverse 每個欄位
-    for i := 0; i < getType.NumField(); i++ {
-        field := getType.Field(i)
-        value := getValue.Field(i).Interface()
-		sql = fmt.Sprintf(`%s (%d,"%s","%v","%s"),`, sql,
-			objId, field.Name, value, field.Type.Name())
-    }
-	sql = strings.TrimRight(sql, ",")
-	sql = sql + ";"
-	db.Db.Exec(sql)
-	data := db.Get(tb, objId)
+func (db *Db) InsertCtx(ctx context.Context, tb string, input interface{}) (map[string]interface{}, error) {
+    getValue, err := structValue(input)
+	if err != nil {
+		return nil, err
+	}
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return nil, err
+	}
+	obj := hookTarget(input) // 見 hooks.go
+	if err := beforeWrite(ctx, obj, true); err != nil {
+		return nil, err
+	}
+	getValue = reflect.Indirect(reflect.ValueOf(obj))
+	var data map[string]interface{}
+	err = db.atomic(ctx, func(db *Db) error {
+		objId, err := db.allocId(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		// 要知道的是，input 每個欄位，對表格來說都是一筆資料
+		rows, err := structRows(objId, getValue, false)
+		if err != nil {
+			return err
+		}
+		if rows, err = db.zeroAsMissing(name, rows, getValue); err != nil {
+			return err
+		}
+		if rows, err = db.checkSchema(ctx, name, objId, rows, nil, true); err != nil {
+			return err
+		}
+		if err := db.insertRows(ctx, name, withVersion(rows, objId, 1)); err != nil {
+			return err
+		}
+		if err := afterInsert(ctx, obj, objId); err != nil {
+			return err
+		}
+		data, err = db.FindCtx(ctx, tb, objId)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 	return data, nil
 }
 
 func (db *Db) Update(tb string, input interface{}) error {
-    getType := reflect.TypeOf(input)
-    getValue := reflect.ValueOf(input)
+	return db.UpdateCtx(context.Background(), tb, input)
+}
 
+func (db *Db) UpdateCtx(ctx context.Context, tb string, input interface{}) error {
+    getValue, err := structValue(input)
+	if err != nil {
+		return err
+	}
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return err
+	}
 	objId := getId(input)
 	if objId == 0 {
 		return fmt.Errorf("Cannot Update table without Id field")
 	}
+	obj := hookCopy(input) // 見 hooks.go
+	if err := beforeWrite(ctx, obj, false); err != nil {
+		return err
+	}
+	getValue = reflect.Indirect(reflect.ValueOf(obj))
 
-	// 透過 reflect.TypeOf().Field(i) 可以 traverse 每個欄位
-    for i := 0; i < getType.NumField(); i++ {
-        field := getType.Field(i)
-        value := getValue.Field(i).Interface()
-		sql := ""
-
-        val := ""
-        sql = fmt.Sprintf(`SELECT Val FROM %s WHERE objId=%d AND Attr="%s";`, tb, objId, field.Name)
-        err := db.Db.Get(&val, sql)
-		typ := field.Type.Name()
-        if err != nil { // !exists
-            sql = fmt.Sprintf(`INSERT INTO %s (objId,Attr,Val,Typ) VALUES
-                (%d,"%s","%v","%v");`, tb, objId, field.Name, value, typ)
-        } else {
-            sql = fmt.Sprintf(`UPDATE %s Set Val="%v" WHERE objId=%d AND Attr="%s";`,
-                tb, value, objId, field.Name)
-		}
-		db.Db.Exec(sql)
-    }
-	return nil
+	rows, err := structRows(objId, getValue, false)
+	if err != nil {
+		return err
+	}
+	return db.updateRows(ctx, name, objId, rows, nil, anyVersion)
+}
+
+// PatchUpdate 同 Update(), 但只寫入有給值的欄位:
+// 零值的欄位略過，指標欄位只要不是 nil 就寫入(即使指向零值), 所以要把欄位改成 0 或 "" 時請用指標
+// BeforeUpdate/Validate 看到的是併入資料庫內目前值的完整物件，見 hooks.go
+func (db *Db) PatchUpdate(tb string, input interface{}) error {
+	return db.PatchUpdateCtx(context.Background(), tb, input)
+}
+
+func (db *Db) PatchUpdateCtx(ctx context.Context, tb string, input interface{}) error {
+	getValue, err := structValue(input)
+	if err != nil {
+		return err
+	}
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return err
+	}
+	objId := getId(input)
+	if objId == 0 {
+		return fmt.Errorf("Cannot Update table without Id field")
+	}
+
+	rows, err := db.patchRows(ctx, name, objId, getValue) // 見 hooks.go
+	if err != nil {
+		return err
+	}
+	return db.updateRows(ctx, name, objId, rows, nil, anyVersion)
 }
 
 // 如果給的資料 Id == 0 || 不存在，則 Insert
-// 如果 Id > 0 && 存在 則 Update
+// 如果 Id > 0 && 存在 則 Update, input 帶有 Version 時必須跟資料庫內的相同，見 UpdateIfVersion()
 // PS: 存不存在由 Id 決定
 func (db *Db) InsOrEdit(tb string, input interface{}) map[string]interface{} {
+	return db.InsOrEditCtx(context.Background(), tb, input)
+}
+
+func (db *Db) InsOrEditCtx(ctx context.Context, tb string, input interface{}) map[string]interface{} {
 	if id := getId(input); id > 0 { // id > 0 才有機會是 Update, 否則一律 Insert
-		if item := db.Get(tb, id); len(item) == 0 { // Not existed
-			item, err := db.Insert(tb, input)
+		if item := db.GetCtx(ctx, tb, id); len(item) == 0 { // Not existed
+			item, err := db.InsertCtx(ctx, tb, input)
 			if err == nil {
 				return item
 			} else {
 				return map[string]interface{}{}
 			}
 		} else {
-			db.Update(tb, input)
-			return db.Get(tb, id)
+			if version, ok := versionOf(input); ok { // 有帶 Version 就檢查
+				if err := db.UpdateIfVersionCtx(ctx, tb, input, version); err != nil {
+					db.logf("database.InsOrEdit() %s\n", err.Error())
+					return map[string]interface{}{}
+				}
+			} else {
+				db.UpdateCtx(ctx, tb, input)
+			}
+			return db.GetCtx(ctx, tb, id)
 		}
 	} else {
-		item, err := db.Insert(tb, input)
+		item, err := db.InsertCtx(ctx, tb, input)
 		if err == nil {
 			return item
 		} else {
@@ -88,9 +157,13 @@ func (db *Db) InsOrEdit(tb string, input interface{}) map[string]interface{} {
 // 如果 Id > 0 && 不存在才 Insert, 否則 Skip
 // PS: 存不存在由 Id 決定
 func (db *Db) InsIfNotExist(tb string, input interface{}) map[string]interface{} {
+	return db.InsIfNotExistCtx(context.Background(), tb, input)
+}
+
+func (db *Db) InsIfNotExistCtx(ctx context.Context, tb string, input interface{}) map[string]interface{} {
 	if id := getId(input); id > 0 { // id > 0 才有機會找出資料項
-		if item := db.Get(tb, id); len(item) == 0 { // Not existed
-			item, err := db.Insert(tb, input)
+		if item := db.GetCtx(ctx, tb, id); len(item) == 0 { // Not existed
+			item, err := db.InsertCtx(ctx, tb, input)
 			if err == nil {
 				return item
 			} else {
@@ -102,8 +175,11 @@ func (db *Db) InsIfNotExist(tb string, input interface{}) map[string]interface{}
 }
 
 func getId(input interface{}) int {
-    getType := reflect.TypeOf(input)
-    getValue := reflect.ValueOf(input)
+    getValue, err := structValue(input)
+	if err != nil {
+		return 0
+	}
+    getType := getValue.Type()
     for i := 0; i < getType.NumField(); i++ {
         field := getType.Field(i)
         value := getValue.Field(i).Interface()
@@ -117,3 +193,36 @@ func getId(input interface{}) int {
     }
 	return 0
 }
+
+// structValue 取出 struct 本身, input 是指標時會先取值
+func structValue(input interface{}) (reflect.Value, error) {
+	v := reflect.Indirect(reflect.ValueOf(input))
+	if v.Kind() != reflect.Struct {
+		return v, fmt.Errorf("expect a struct or pointer to struct, got %T", input)
+	}
+	return v, nil
+}
+
+// structRows 將 struct 每個欄位轉成一筆 Table 資料
+// Id 欄位就是 ObjId, 不另外存; 沒有匯出的欄位也不存
+// patch = true 時零值的欄位不存(標了 omitempty 的欄位也一樣), Insert/Update 則每個欄位都存
+func structRows(objId int, v reflect.Value, patch bool) ([]Table, error) {
+	getType := v.Type()
+	rows := make([]Table, 0, getType.NumField())
+	// 透過 reflect.TypeOf().Field(i) 可以 traverse 每個欄位
+	for i := 0; i < getType.NumField(); i++ {
+		field := getType.Field(i)
+		if field.Name == "Id" || field.PkgPath != "" {
+			continue
+		}
+		if patch && v.Field(i).IsZero() {
+			continue
+		}
+		val, typ, err := encodeAttr(v.Field(i).Interface())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", field.Name, err.Error())
+		}
+		rows = append(rows, Table{ObjId: objId, Attr: field.Name, Val: val, Typ: typ})
+	}
+	return rows, nil
+}
@@ -0,0 +1,102 @@
+package database
+
+// 交易 (unit of work), 用法:
+//   err := db.Tx(ctx, func(tx *database.Tx) error {
+//       if _, err := tx.Insert("demo", simba); err != nil {
+//           return err	// 傳回 error 或 panic 都會 rollback
+//       }
+//       return tx.MapUpdate("demo", wade)
+//   })
+// Tx 內嵌一份 Db, 所以 Db 所有的方法都能用，且都在同一個 sqlx.Tx 內執行
+// 在 Tx 裡面再呼叫 tx.Tx() 會用 SAVEPOINT, 內層失敗只會 rollback 到 savepoint
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type Tx struct {
+	*Db
+}
+
+// Tx 在交易內執行 fn, fn 傳回 error 或 panic 時 rollback, 否則 commit
+func (db *Db) Tx(ctx context.Context, fn func(tx *Tx) error) (err error) {
+	if db.tx != nil {
+		return db.savepoint(ctx, fn)
+	}
+	sqltx, err := db.Db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	child := *db
+	child.tx = sqltx
+	child.depth = 0
+	child.events = &eventBuf{}
+	child.histAt = new(time.Time) // savepoint 共用
+	defer func() {
+		if p := recover(); p != nil {
+			sqltx.Rollback()
+			panic(p)
+		}
+	}()
+	if err = fn(&Tx{Db: &child}); err != nil {
+		sqltx.Rollback()
+		return err
+	}
+	if err = sqltx.Commit(); err != nil {
+		return err
+	}
+	db.publish(child.events)
+	return nil
+}
+
+// savepoint 巢狀的交易
+func (db *Db) savepoint(ctx context.Context, fn func(tx *Tx) error) (err error) {
+	child := *db
+	child.depth = db.depth + 1
+	child.events = &eventBuf{}
+	sp := fmt.Sprintf("sp_%d", child.depth)
+	if _, err = db.tx.ExecContext(ctx, "SAVEPOINT " + sp); err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			db.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT " + sp)
+			panic(p)
+		}
+	}()
+	if err = fn(&Tx{Db: &child}); err != nil {
+		db.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT " + sp)
+		db.tx.ExecContext(ctx, "RELEASE SAVEPOINT " + sp)
+		return err
+	}
+	if _, err = db.tx.ExecContext(ctx, "RELEASE SAVEPOINT " + sp); err != nil {
+		return err
+	}
+	db.events.add(child.events.changes...)	// rollback 到 savepoint 時內層的事件就丟掉
+	return nil
+}
+
+// atomic 讓一個需要多個 SQL 的操作(例如 Insert 要先找 ObjId) 全部成功或全部失敗
+// 已經在交易內時則用 savepoint
+func (db *Db) atomic(ctx context.Context, fn func(db *Db) error) error {
+	return db.Tx(ctx, func(tx *Tx) error {
+		return fn(tx.Db)
+	})
+}
+
+// rebind 把 SQL 裡的 ? 換成 Dialect 的 placeholder, 不看 driver 名稱，包過或自訂名稱的 driver 也對
+func (db *Db) rebind(sql string) string {
+	return sqlx.Rebind(db.Dialect().BindType(), sql)
+}
+
+// x 傳回目前要執行 SQL 的對象，在交易內就是 sqlx.Tx
+func (db *Db) x() sqlx.ExtContext {
+	if db.tx != nil {
+		return db.tx
+	}
+	return db.Db
+}
@@ -0,0 +1,252 @@
+package database
+
+// 每個物件都有 Version 屬性(int), Insert 時為 1, 每次 Update 加 1, 由 database 自己維護，input 裡的 Version 會被忽略
+// 兩個人同時編輯同一個物件時，後存的會蓋掉先存的，所以可以帶上讀出來時的 Version:
+//   item := db.Get("member", 1)
+//   item["Name"] = "Simba"
+//   err := db.UpdateIfVersion("member", item, item["Version"].(int))
+//   if errors.Is(err, database.ErrConflict) { ... } // 有人先改了，重新讀取再改
+// InsOrEdit()/MapInsOrEdit() 的 input 帶有 Version 時也會檢查
+// 其他的寫入不檢查版本，同時更新時跟以前一樣後寫的為準，只有上面這些會傳回 ErrConflict
+// 開始維護 Version 之前就存在的物件視為 Version 0
+
+import (
+	"context"
+	dbsql "database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// VersionAttr 記錄版本的屬性
+const VersionAttr = "Version"
+
+// anyVersion 給 updateRows() 表示不檢查版本
+const anyVersion = -1
+
+// ConflictError 是 UpdateIfVersion() 版本不符時傳回的錯誤，可以用 errors.Is(err, ErrConflict) 判斷
+type ConflictError struct {
+	Table    string
+	ObjId    int
+	Expected int // 呼叫端給的版本
+	Actual   int // 資料庫內的版本
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s: %s(%d) expected version %d, got %d", ErrConflict.Error(), e.Table, e.ObjId, e.Expected, e.Actual)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// UpdateIfVersion 同 Update()/MapUpdate(), 但資料庫內的 Version 必須是 expected, 否則傳回 *ConflictError
+// input 可以是 struct, 指向 struct 的指標或 map[string]interface{}
+func (db *Db) UpdateIfVersion(tb string, input interface{}, expected int) error {
+	return db.UpdateIfVersionCtx(context.Background(), tb, input, expected)
+}
+
+func (db *Db) UpdateIfVersionCtx(ctx context.Context, tb string, input interface{}, expected int) error {
+	name, err := ParseIdent(tb)
+	if err != nil {
+		return err
+	}
+	if expected < 0 {
+		return fmt.Errorf("UpdateIfVersion(%s): negative version %d", tb, expected)
+	}
+	var objId int
+	var rows []Table
+	if m, ok := input.(map[string]interface{}); ok {
+		if objId, err = mapId(m); err != nil {
+			return err
+		}
+		if m, err = db.mapBeforeUpdate(ctx, name, objId, m, nil); err != nil {
+			return err
+		}
+		rows, err = mapRows(objId, m)
+	} else {
+		if _, err := structValue(input); err != nil {
+			return err
+		}
+		objId = getId(input)
+		obj := hookCopy(input)
+		if err := beforeWrite(ctx, obj, false); err != nil {
+			return err
+		}
+		rows, err = structRows(objId, reflect.Indirect(reflect.ValueOf(obj)), false)
+	}
+	if err != nil {
+		return err
+	}
+	if objId <= 0 {
+		return fmt.Errorf("Cannot Update table without Id field")
+	}
+	return db.updateRows(ctx, name, objId, rows, nil, expected)
+}
+
+// withVersion 去掉 rows 裡的 Version, 再加上 Version = version
+func withVersion(rows []Table, objId, version int) []Table {
+	return append(dropVersion(rows), Table{ObjId: objId, Attr: VersionAttr, Val: strconv.Itoa(version), Typ: "int"})
+}
+
+// dropVersion 去掉 rows 裡的 Version, input 帶的 Version 不寫入
+func dropVersion(rows []Table) []Table {
+	res := make([]Table, 0, len(rows)+1)
+	for _, r := range rows {
+		if r.Attr != VersionAttr {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// bumpVersion 把物件的 Version 加 1, expected 不是 anyVersion 時必須等於目前的 Version
+// 用 UPDATE ... WHERE Val=舊版本，同時有別人更新時只有一個會成功
+// anyVersion 則見 bumpVersions(), 不會傳回 ConflictError
+func (db *Db) bumpVersion(ctx context.Context, tb Ident, objId, expected int) error {
+	if expected == anyVersion {
+		return db.bumpVersions(ctx, tb, []int{objId})
+	}
+	cur, exists, err := db.version(ctx, tb, objId)
+	if err != nil {
+		return err
+	}
+	if cur != expected {
+		return &ConflictError{Table: string(tb), ObjId: objId, Expected: expected, Actual: cur}
+	}
+	if !exists {
+		return db.insertRows(ctx, tb, withVersion(nil, objId, cur+1))
+	}
+	return db.tracked(ctx, tb, "ObjId=?", []interface{}{objId}, func(db *Db) error {
+		sql := fmt.Sprintf("UPDATE %s SET Val=?, Typ='int' WHERE ObjId=? AND Attr=? AND Val=?;", tb)
+		res, err := db.x().ExecContext(ctx, db.rebind(sql), strconv.Itoa(cur+1), objId, VersionAttr, strconv.Itoa(cur))
+		if err != nil {
+			return queryError(tb, sql, err)
+		}
+		if affected(res) == 0 { // 讀出來之後被別人改了
+			actual, _, err := db.version(ctx, tb, objId)
+			if err != nil {
+				return err
+			}
+			return &ConflictError{Table: string(tb), ObjId: objId, Expected: cur, Actual: actual}
+		}
+		return nil
+	})
+}
+
+// bumpVersions 把 objIds 的 Version 加 1, 不檢查版本，沒有 Version 的物件變成 1
+// 在 SQL 裡直接加 1, 同時有別人更新時兩邊都會成功，跟以前一樣後寫的為準
+func (db *Db) bumpVersions(ctx context.Context, tb Ident, objIds []int) error {
+	for len(objIds) > 0 {
+		ids := objIds
+		if len(ids) > 500 { // placeholder 的數量有上限
+			ids = ids[:500]
+		}
+		objIds = objIds[len(ids):]
+		where := "ObjId IN (?" + strings.Repeat(",?", len(ids)-1) + ")"
+		args := make([]interface{}, 0, len(ids)+1)
+		for _, id := range ids {
+			args = append(args, id)
+		}
+		err := db.tracked(ctx, tb, where, args, func(db *Db) error {
+			has := []int{}
+			sql := fmt.Sprintf("SELECT ObjId FROM %s WHERE Attr=? AND %s;", tb, where)
+			if err := sqlx.SelectContext(ctx, db.x(), &has, db.rebind(sql), append([]interface{}{VersionAttr}, args...)...); err != nil {
+				return queryError(tb, sql, err)
+			}
+			found := make(map[int]bool, len(has))
+			for _, id := range has {
+				found[id] = true
+			}
+			sql = db.Dialect().InsertIgnore(tb, "ObjId", "Attr", "Val", "Typ") // 同時有別人補上時略過
+			for _, id := range ids {
+				if found[id] {
+					continue
+				}
+				if _, err := db.x().ExecContext(ctx, db.rebind(sql), id, VersionAttr, "0", "int"); err != nil {
+					return queryError(tb, sql, err)
+				}
+				found[id] = true
+			}
+			sql = fmt.Sprintf("UPDATE %s SET Val=%s+1, Typ='int' WHERE Attr=? AND %s;", tb, db.Dialect().Column("Val", "int"), where)
+			_, err := db.x().ExecContext(ctx, db.rebind(sql), append([]interface{}{VersionAttr}, args...)...)
+			return queryError(tb, sql, err)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bumpVersionsWhere 符合 where 的物件 Version 加 1, 要在改動之前呼叫，改動之後可能就不符合 where 了
+func (db *Db) bumpVersionsWhere(ctx context.Context, tb Ident, where string, args []interface{}) error {
+	ids := []int{}
+	sql := fmt.Sprintf("SELECT DISTINCT ObjId FROM %s WHERE %s;", tb, where)
+	if err := sqlx.SelectContext(ctx, db.x(), &ids, db.rebind(sql), args...); err != nil {
+		return queryError(tb, sql, err)
+	}
+	return db.bumpVersions(ctx, tb, ids)
+}
+
+// version 傳回物件目前的 Version, 沒有 Version 屬性時為 0, false
+func (db *Db) version(ctx context.Context, tb Ident, objId int) (int, bool, error) {
+	val := ""
+	sql := fmt.Sprintf("SELECT Val FROM %s WHERE ObjId=? AND Attr=?;", tb)
+	err := db.x().QueryRowxContext(ctx, db.rebind(sql), objId, VersionAttr).Scan(&val)
+	if errors.Is(err, dbsql.ErrNoRows) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, queryError(tb, sql, err)
+	}
+	cur, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, false, fmt.Errorf("%s(%d): invalid %s %q", tb, objId, VersionAttr, val)
+	}
+	return cur, true, nil
+}
+
+// versionOf 取出 input 帶的 Version, struct 的 Version 欄位是 0 時視為沒有帶
+func versionOf(input interface{}) (int, bool) {
+	var v interface{}
+	if m, ok := input.(map[string]interface{}); ok {
+		if v, ok = m[VersionAttr]; !ok {
+			return 0, false
+		}
+	} else if sv, err := structValue(input); err == nil {
+		f := sv.FieldByName(VersionAttr)
+		if !f.IsValid() || f.IsZero() {
+			return 0, false
+		}
+		v = f.Interface()
+	}
+	return intOf(v)
+}
+
+// intOf 把 map 裡的數字轉成 int, 例如 json 解出來的 float64 與 json.Number, 數字的字串也可以
+// 不是數字時傳回 false
+func intOf(v interface{}) (int, bool) {
+	if n, ok := v.(json.Number); ok {
+		v = n.String()
+	}
+	rv := reflect.ValueOf(v)
+	switch {
+	case !rv.IsValid():
+	case rv.Kind() >= reflect.Int && rv.Kind() <= reflect.Int64:
+		return int(rv.Int()), true
+	case isUint(rv.Kind()):
+		return int(rv.Uint()), true
+	case rv.Kind() == reflect.Float32 || rv.Kind() == reflect.Float64:
+		return int(rv.Float()), true
+	case rv.Kind() == reflect.String:
+		if n, err := strconv.Atoi(rv.String()); err == nil {
+			return n, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,230 @@
+package database
+
+// 一般的 Update 不檢查版本，同時更新同一個物件時都要成功，只有 UpdateIfVersion() 會傳回 ErrConflict
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+type versioned struct {
+	Id   int
+	Name string
+	Age  int
+}
+
+func TestConcurrentUpdate(t *testing.T) {
+	const workers, perWorker = 8, 10
+	dir, err := ioutil.TempDir("", "dbx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := Connect(filepath.Join(dir, "version.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Db.Close()
+	if err := db.CreateTb("demo", true); err != nil {
+		t.Fatal(err)
+	}
+	item, err := db.MapInsert("demo", map[string]interface{}{"Name": "a", "Age": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := item["Id"].(int)
+
+	writes := []func(i int) error{
+		func(i int) error { return db.MapUpdate("demo", map[string]interface{}{"Id": id, "Age": i}) },
+		func(i int) error { return db.Update("demo", versioned{Id: id, Name: "b", Age: i}) },
+		func(i int) error { return db.PatchUpdate("demo", versioned{Id: id, Age: i + 1}) },
+		func(i int) error { return db.UnsetAttrs("demo", id, "Tmp") },
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				if err := writes[(w+i)%len(writes)](i); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	item, err = db.Find("demo", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 1 + workers*perWorker; item[VersionAttr] != want {
+		t.Fatalf("Version = %v, want %d", item[VersionAttr], want)
+	}
+	err = db.UpdateIfVersion("demo", map[string]interface{}{"Id": id, "Age": 0}, 1)
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("UpdateIfVersion with stale version: %v, want ErrConflict", err)
+	}
+}
+
+// 開始維護 Version 之前就存在的物件視為 Version 0, 更新後是 1
+func TestUpdateWithoutVersion(t *testing.T) {
+	db, err := Connect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Db.SetMaxOpenConns(1) // :memory: 每個連線是不同的資料庫
+	if err := db.CreateTb("demo", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Db.Exec("INSERT INTO demo (ObjId,Attr,Val,Typ) VALUES (7,'Name','a','string');"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.MapUpdate("demo", map[string]interface{}{"Id": 7, "Name": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateIfVersion("demo", map[string]interface{}{"Id": 7, "Name": "c"}, 1); err != nil {
+		t.Fatal(err)
+	}
+	item, err := db.Find("demo", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item["Name"] != "c" || item[VersionAttr] != 2 {
+		t.Fatalf("got %v, want Name c, Version 2", item)
+	}
+}
+
+// 匯入、soft delete、屬性的 migration 也會讓 Version 加 1, 之前讀出的版本 UpdateIfVersion() 會失敗
+func TestVersionBumpedByOtherWrites(t *testing.T) {
+	db, err := Connect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Db.SetMaxOpenConns(1) // :memory: 每個連線是不同的資料庫
+	if err := db.CreateTb("demo", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Db.Exec("CREATE TABLE src (id INTEGER PRIMARY KEY, Name TEXT, Version INTEGER);"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Db.Exec("INSERT INTO src VALUES (1, 'a', 99);"); err != nil {
+		t.Fatal(err)
+	}
+	item, err := db.MapInsert("demo", map[string]interface{}{"Name": "x", "Nick": "n", "Age": "30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := item["Id"].(int)
+	if err := db.EnableSoftDelete("demo"); err != nil {
+		t.Fatal(err)
+	}
+
+	writes := []struct {
+		name string
+		fn   func() error
+	}{
+		{"ImportHorizontal", func() error { _, err := db.ImportHorizontal("src", "demo", "id"); return err }},
+		{"Del", func() error { return db.Del("demo", id) }},
+		{"Restore", func() error { return db.Restore("demo", id) }},
+		{"RenameAttr", func() error { _, err := db.RenameAttr("demo", "Nick", "Alias"); return err }},
+		{"RetypeAttr", func() error { _, err := db.RetypeAttr("demo", "Age", "int"); return err }},
+		{"DefaultAttr", func() error { _, err := db.DefaultAttr("demo", "Level", 1); return err }},
+		{"DropAttr", func() error { _, err := db.DropAttr("demo", "Level"); return err }},
+	}
+	version := 1
+	for _, w := range writes {
+		if err := w.fn(); err != nil {
+			t.Fatalf("%s: %v", w.name, err)
+		}
+		cur, _, err := db.version(context.Background(), "demo", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cur != version+1 {
+			t.Fatalf("%s: Version = %d, want %d", w.name, cur, version+1)
+		}
+		err = db.UpdateIfVersion("demo", map[string]interface{}{"Id": id}, version)
+		if !errors.Is(err, ErrConflict) {
+			t.Fatalf("UpdateIfVersion after %s: %v, want ErrConflict", w.name, err)
+		}
+		version = cur
+	}
+
+	// 沒有 idColumn 時新的物件 Version 為 1, 來源的 Version 欄位不寫入
+	if _, err := db.ImportHorizontal("src", "demo", ""); err != nil {
+		t.Fatal(err)
+	}
+	items, err := db.FindByFilter("demo", "Attr=? AND Val=?", "Name", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range items {
+		if item["Id"] != 1 && item[VersionAttr] != 1 {
+			t.Errorf("imported object %v, want Version 1", item)
+		}
+	}
+}
+
+// json 解出來的 Id 是 float64 或 json.Number, 不是數字時傳回 error, 不會 panic
+func TestMapId(t *testing.T) {
+	db, err := Connect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Db.SetMaxOpenConns(1) // :memory: 每個連線是不同的資料庫
+	if err := db.CreateTb("demo", false); err != nil {
+		t.Fatal(err)
+	}
+	item, err := db.MapInsert("demo", map[string]interface{}{"Name": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := item["Id"].(int)
+
+	var input map[string]interface{}
+	if err := json.Unmarshal([]byte(fmt.Sprintf(`{"Id": %d, "Name": "b", "Version": 1}`, id)), &input); err != nil {
+		t.Fatal(err)
+	}
+	if got := db.MapGetId(input); got != id {
+		t.Errorf("MapGetId(float64) = %d, want %d", got, id)
+	}
+	if err := db.UpdateIfVersion("demo", input, 1); err != nil {
+		t.Fatal(err)
+	}
+	input = map[string]interface{}{"Id": json.Number(strconv.Itoa(id)), "Name": "c", "Version": json.Number("2")}
+	if item := db.MapInsOrEdit("demo", input); item["Name"] != "c" || item[VersionAttr] != 3 {
+		t.Errorf("MapInsOrEdit(json.Number) = %v, want Name c, Version 3", item)
+	}
+
+	bad := map[string]interface{}{"Id": "x", "Name": "d"}
+	if got := db.MapGetId(bad); got != -1 {
+		t.Errorf("MapGetId(string) = %d, want -1", got)
+	}
+	if err := db.MapUpdate("demo", bad); err == nil {
+		t.Error("MapUpdate with non-numeric Id succeeded")
+	}
+	if err := db.UpdateIfVersion("demo", bad, 3); err == nil {
+		t.Error("UpdateIfVersion with non-numeric Id succeeded")
+	}
+	if item := db.MapInsOrEdit("demo", bad); len(item) != 0 {
+		t.Errorf("MapInsOrEdit with non-numeric Id = %v, want empty", item)
+	}
+	if items, _ := db.FindAll("demo"); len(items) != 1 {
+		t.Errorf("%d objects, want 1", len(items))
+	}
+}
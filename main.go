@@ -2,6 +2,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"dbx/database"
 	//ms "dbx/mapstruct"
@@ -107,6 +108,46 @@ func CreateTb(tb string, dropFirst bool) (err error) {
 	return db.CreateTb(tb, dropFirst)
 }
 
+func DropTb(tb string) error {
+	return db.DropTb(tb)
+}
+
+func SetSchema(tb string, s *database.Schema) error {
+	return db.SetSchema(tb, s)
+}
+
+func EnableHistory(tb string) error {
+	return db.EnableHistory(tb)
+}
+
+func EnableSoftDelete(tb string) error {
+	return db.EnableSoftDelete(tb)
+}
+
+func Subscribe(tb string, fn func(database.Event)) (func(), error) {
+	return db.Subscribe(tb, fn)
+}
+
+func SubscribeChan(tb string, size int) (<-chan database.Event, func(), error) {
+	return db.SubscribeChan(tb, size)
+}
+
+func CreateIndex(tb, attr string) error {
+	return db.CreateIndex(tb, attr)
+}
+
+func CreatePivotView(tb string, attrs []string, view string, opts ...database.PivotOption) error {
+	return db.CreatePivotView(tb, attrs, view, opts...)
+}
+
+func ImportHorizontal(src, dst, idColumn string, opts ...database.HorizontalOption) (database.HorizontalReport, error) {
+	return db.ImportHorizontal(src, dst, idColumn, opts...)
+}
+
+func ExportHorizontal(tb, dst string, opts ...database.HorizontalOption) (database.HorizontalReport, error) {
+	return db.ExportHorizontal(tb, dst, opts...)
+}
+
 func Insert(tb string, input interface{}) (map[string]interface{}, error) {
  	return db.Insert(tb, input)
 }
@@ -115,6 +156,14 @@ func Update(tb string, input interface{}) error {
 	return db.Update(tb, input)
 }
 
+func UpdateIfVersion(tb string, input interface{}, expected int) error {
+	return db.UpdateIfVersion(tb, input, expected)
+}
+
+func PatchUpdate(tb string, input interface{}) error {
+	return db.PatchUpdate(tb, input)
+}
+
 func InsOrEdit(tb string, input interface{}) map[string]interface{} {
 	return db.InsOrEdit(tb, input)
 }
@@ -131,18 +180,78 @@ func Gets(tb string) []map[string]interface{} {
 	return db.Gets(tb)
 }
 
-func GetsByFilter(tb, filter string) []map[string]interface{} {
-	return db.GetsByFilter(tb, filter)
+func GetsPage(tb string, opts database.PageOpts) database.Page {
+	return db.GetsPage(tb, opts)
+}
+
+func GetsByFilter(tb, filter string, args ...interface{}) []map[string]interface{} {
+	return db.GetsByFilter(tb, filter, args...)
+}
+
+func GetsWhere(tb string, filter database.Filter) []map[string]interface{} {
+	return db.GetsWhere(tb, filter)
+}
+
+func GetsByRange(tb, attr string, min, max interface{}) []map[string]interface{} {
+	return db.GetsByRange(tb, attr, min, max)
+}
+
+func ForEach(tb string, fn func(item map[string]interface{}) error) error {
+	return db.ForEach(tb, fn)
+}
+
+func Find(tb string, id int) (map[string]interface{}, error) {
+	return db.Find(tb, id)
+}
+
+func FindAll(tb string) ([]map[string]interface{}, error) {
+	return db.FindAll(tb)
+}
+
+func GetAsOf(tb string, id int, at time.Time) (map[string]interface{}, error) {
+	return db.GetAsOf(tb, id, at)
+}
+
+func History(tb string, id int, attr string) ([]database.Change, error) {
+	return db.History(tb, id, attr)
 }
 
 func Del(tb string, id int) error {
 	return db.Del(tb, id)
 }
 
+func Restore(tb string, id int) error {
+	return db.Restore(tb, id)
+}
+
+func Purge(tb string, olderThan time.Duration) (int, error) {
+	return db.Purge(tb, olderThan)
+}
+
 func DelsBy(tb, field string, min, max int) error {
 	return db.DelsBy(tb, field, min, max)
 }
 
+func UnsetAttrs(tb string, id int, attrs ...string) error {
+	return db.UnsetAttrs(tb, id, attrs...)
+}
+
+func RenameAttr(tb, from, to string) (int, error) {
+	return db.RenameAttr(tb, from, to)
+}
+
+func RetypeAttr(tb, attr, typ string) (int, error) {
+	return db.RetypeAttr(tb, attr, typ)
+}
+
+func DefaultAttr(tb, attr string, v interface{}) (int, error) {
+	return db.DefaultAttr(tb, attr, v)
+}
+
+func DropAttr(tb, attr string) (int, error) {
+	return db.DropAttr(tb, attr)
+}
+
 func MapInsert(tb string, input map[string]interface{}) (map[string]interface{}, error) {
 	return db.MapInsert(tb, input)
 }
@@ -151,8 +260,8 @@ func MapAryInsert(tb string, data []map[string]string, check bool) error {
 	return db.MapAryInsert(tb, data, check)
 }
 
-func MapUpdate(tb string, input map[string]interface{}) error {
-	return db.MapUpdate(tb, input)
+func MapUpdate(tb string, input map[string]interface{}, opts ...database.UpdateOption) error {
+	return db.MapUpdate(tb, input, opts...)
 }
 
 func MapInsOrEdit(tb string, input map[string]interface{}) map[string]interface{} {
@@ -3,6 +3,8 @@ package time
 import (
     "errors"
     "fmt"
+    "strconv"
+    "strings"
     "time"
 )
 
@@ -21,12 +23,13 @@ var layouts = []string{
     "2006-01-02 15:04:05.000",  // Custom UTC
 }
 
+// JSON 字串要有雙引號，否則放在 struct 或 slice 裡面時 json.Marshal 會失敗
 func (t Time) MarshalJSON() ([]byte, error) {
-	return []byte(fmt.Sprintf(`%s`,t.String())), nil
+	return []byte(strconv.Quote(t.String())), nil
 }
 
 func (t *Time) UnmarshalJSON(b []byte) (error) {
-    timeString := string(b)
+    timeString := strings.Trim(string(b), `"`)
     for _, layout := range layouts {
         tt, err := time.Parse(layout, timeString)
         if err == nil {